@@ -0,0 +1,142 @@
+//
+// accept.go - Accept loop that rides out errors instead of exiting
+//
+// Copyright (C) 2013 Ryan A. Chapman. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+//      this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+//      this list of conditions and the following disclaimer in the documentation
+//      and/or other materials provided with the distribution.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHORS
+// OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+// When we run out of file descriptors, accept() fails until some tunnels
+// finish. Rather than exiting, or spinning on the error, the loop backs off
+// exponentially and, with -shedidle, closes the oldest tunnels that have been
+// idle for a while to make room.
+//
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+
+	log "github.com/zdannar/flogger"
+)
+
+const (
+	acceptMinBackoff = 5 * time.Millisecond
+	acceptMaxBackoff = 1 * time.Second
+	// how many idle tunnels to close each time accept() runs out of fds
+	acceptShedBatch = 16
+)
+
+const (
+	acceptErrClosed = iota
+	acceptErrFdLimit
+	acceptErrTemporary
+	acceptErrOther
+)
+
+var acceptErrClassNames = []string{"listener closed", "out of file descriptors", "temporary", "unexpected"}
+
+type tcpAcceptor interface {
+	AcceptTCP() (*net.TCPConn, error)
+}
+
+func classifyAcceptError(err error) int {
+	switch {
+	case errors.Is(err, net.ErrClosed):
+		return acceptErrClosed
+	case errors.Is(err, syscall.EMFILE), errors.Is(err, syscall.ENFILE):
+		return acceptErrFdLimit
+	case errors.Is(err, syscall.ECONNABORTED), errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.EINTR), errors.Is(err, syscall.EAGAIN),
+		errors.Is(err, syscall.ENOBUFS), errors.Is(err, syscall.ENOMEM),
+		errors.Is(err, syscall.EPROTO), errors.Is(err, syscall.EPERM):
+		return acceptErrTemporary
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return acceptErrTemporary
+	}
+	return acceptErrOther
+}
+
+// acceptLoop accepts connections and hands them to handle until the listener
+// is closed. Any other error is counted, logged and retried after a backoff.
+func acceptLoop(l tcpAcceptor, handle func(*net.TCPConn)) {
+	var backoff time.Duration
+	for {
+		acceptLoopWaiting(true)
+		conn, err := l.AcceptTCP()
+		acceptLoopWaiting(false)
+		if err == nil {
+			backoff = 0
+			incrAcceptSuccesses()
+			go handle(conn)
+			continue
+		}
+
+		class := classifyAcceptError(err)
+		if class == acceptErrClosed {
+			return
+		}
+		incrAcceptErrors()
+		switch class {
+		case acceptErrFdLimit:
+			incrAcceptFdLimitErrors()
+		case acceptErrTemporary:
+			incrAcceptTemporaryErrors()
+		default:
+			incrAcceptOtherErrors()
+		}
+
+		if backoff == 0 {
+			backoff = acceptMinBackoff
+		} else if backoff *= 2; backoff > acceptMaxBackoff {
+			backoff = acceptMaxBackoff
+		}
+		log.Infof("ERR: Error accepting connection (%s): %v; retrying in %v", acceptErrClassNames[class], err, backoff)
+		if class == acceptErrFdLimit && gShedIdle > 0 {
+			if n := shedIdleTunnels(gShedIdle, acceptShedBatch); n > 0 {
+				log.Infof("Closed %d tunnels idle for more than %v to free file descriptors", n, gShedIdle)
+			}
+		}
+		time.Sleep(backoff)
+	}
+}
+
+// shedIdleTunnels closes up to max of the oldest tunnels that have been idle
+// for at least minIdle and returns how many it closed.
+func shedIdleTunnels(minIdle time.Duration, max int) int {
+	n := 0
+	for _, t := range activeTunnels() {
+		if n >= max {
+			break
+		}
+		if idle := t.idle(); idle >= minIdle {
+			log.Debugf("Shedding tunnel %v, idle for %v", t, idle)
+			t.close()
+			incrShedTunnels()
+			n++
+		}
+	}
+	return n
+}
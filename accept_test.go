@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeAcceptor returns the given errors, in order, then reports the listener closed.
+type fakeAcceptor struct {
+	errs []error
+}
+
+func (a *fakeAcceptor) AcceptTCP() (*net.TCPConn, error) {
+	if len(a.errs) == 0 {
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: net.ErrClosed}
+	}
+	err := a.errs[0]
+	a.errs = a.errs[1:]
+	return nil, err
+}
+
+func acceptErr(errno syscall.Errno) error {
+	return &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept4", errno)}
+}
+
+func TestClassifyAcceptError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{&net.OpError{Op: "accept", Net: "tcp", Err: net.ErrClosed}, acceptErrClosed},
+		{acceptErr(syscall.EMFILE), acceptErrFdLimit},
+		{acceptErr(syscall.ENFILE), acceptErrFdLimit},
+		{acceptErr(syscall.ECONNABORTED), acceptErrTemporary},
+		{acceptErr(syscall.ENOBUFS), acceptErrTemporary},
+		{acceptErr(syscall.EINVAL), acceptErrOther},
+		{errors.New("something else"), acceptErrOther},
+	}
+	for _, tt := range tests {
+		if got := classifyAcceptError(tt.err); got != tt.want {
+			t.Errorf("classifyAcceptError(%v) = %s, want %s", tt.err, acceptErrClassNames[got], acceptErrClassNames[tt.want])
+		}
+	}
+}
+
+func TestAcceptLoopSurvivesErrors(t *testing.T) {
+	fdLimit, temporary, other := numAcceptFdLimitErrors(), numAcceptTemporaryErrors(), numAcceptOtherErrors()
+	a := &fakeAcceptor{errs: []error{
+		acceptErr(syscall.EMFILE),
+		acceptErr(syscall.EMFILE),
+		acceptErr(syscall.ECONNABORTED),
+		acceptErr(syscall.EINVAL),
+	}}
+
+	done := make(chan bool)
+	go func() {
+		acceptLoop(a, func(*net.TCPConn) {})
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("accept loop did not return after the listener was closed")
+	}
+
+	if n := numAcceptFdLimitErrors() - fdLimit; n != 2 {
+		t.Errorf("counted %d out of fd errors, want 2", n)
+	}
+	if n := numAcceptTemporaryErrors() - temporary; n != 1 {
+		t.Errorf("counted %d temporary errors, want 1", n)
+	}
+	if n := numAcceptOtherErrors() - other; n != 1 {
+		t.Errorf("counted %d unexpected errors, want 1", n)
+	}
+}
+
+func tcpPair(t testing.TB) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer l.Close()
+	c, err := net.DialTCP("tcp", nil, l.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	s, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatalf("could not accept: %v", err)
+	}
+	return c, s
+}
+
+func TestShedIdleTunnels(t *testing.T) {
+	idleClient, idleRemote := tcpPair(t)
+	defer idleRemote.Close()
+	idleServer, idleServerRemote := tcpPair(t)
+	defer idleServerRemote.Close()
+	busyClient, busyRemote := tcpPair(t)
+	defer busyRemote.Close()
+	busyServer, busyServerRemote := tcpPair(t)
+	defer busyServerRemote.Close()
+
+	idle := trackTunnel(idleClient, idleServer, "192.0.2.1:443", viaDirect)
+	defer untrackTunnel(idle)
+	busy := trackTunnel(busyClient, busyServer, "192.0.2.2:443", viaDirect)
+	defer untrackTunnel(busy)
+	defer busy.close()
+
+	time.Sleep(300 * time.Millisecond)
+	busyRemote.Write([]byte("x"))
+	buf := make([]byte, 1)
+	busyClient.Read(buf)
+
+	if n := shedIdleTunnels(200*time.Millisecond, acceptShedBatch); n != 1 {
+		t.Errorf("shedIdleTunnels() closed %d tunnels, want 1", n)
+	}
+	idleRemote.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := idleRemote.Read(buf); err == nil {
+		t.Errorf("idle tunnel was not closed")
+	}
+	if _, err := busyClient.Write([]byte("x")); err != nil {
+		t.Errorf("busy tunnel was closed: %v", err)
+	}
+}
@@ -0,0 +1,294 @@
+//
+// admin.go - HTTP API for inspecting and controlling a running any_proxy
+//
+// Copyright (C) 2013 Ryan A. Chapman. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+//      this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+//      this list of conditions and the following disclaimer in the documentation
+//      and/or other materials provided with the distribution.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHORS
+// OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+// Endpoints (all requests need "Authorization: Bearer TOKEN" when -admintoken is set):
+//
+//   GET  /connections                            list active tunnels
+//   POST /connections/kill?id=N                  close a tunnel
+//   GET  /upstreams                              list upstream proxies and their state
+//   POST /upstreams/state?upstream=H:P&state=S   set state to up, draining or down
+//   GET  /directs                                list directs
+//   POST /directs/add?direct=IP_OR_CIDR          add a direct
+//   POST /directs/remove?direct=IP_OR_CIDR       remove a direct
+//   POST /reload                                 same as sending SIGHUP
+//   POST /loglevel?level=debug|info              change the log level
+//
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/zdannar/flogger"
+)
+
+type adminTunnel struct {
+	ID       uint64 `json:"id"`
+	Client   string `json:"client"`
+	Dst      string `json:"dst"`
+	Via      string `json:"via"`
+	Protocol string `json:"protocol,omitempty"`
+	JA3      string `json:"ja3,omitempty"`
+	JA4      string `json:"ja4,omitempty"`
+	Started  string `json:"started"`
+	Age      string `json:"age"`
+}
+
+type adminUpstream struct {
+	Upstream string `json:"upstream"`
+	State    string `json:"state"`
+	Tunnels  int    `json:"tunnels"`
+}
+
+// listenAdmin listens on a unix socket if addr is "unix:PATH" or an absolute
+// path, otherwise on a TCP address which must be a loopback address.
+func listenAdmin(addr string) (net.Listener, error) {
+	path := strings.TrimPrefix(addr, "unix:")
+	if path != addr || strings.HasPrefix(addr, "/") {
+		// a stale socket from an earlier run is replaced, anything else is left alone
+		if fi, err := os.Lstat(path); err == nil {
+			if fi.Mode()&os.ModeSocket == 0 {
+				return nil, fmt.Errorf("%s exists and is not a socket", path)
+			}
+			os.Remove(path)
+		}
+		ln, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(path, 0600); err != nil {
+			ln.Close()
+			return nil, err
+		}
+		return ln, nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if host != "localhost" {
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsLoopback() {
+			return nil, fmt.Errorf("admin listener must be bound to localhost or a unix socket, not %q", host)
+		}
+	}
+	if gAdminToken == "" {
+		return nil, errors.New("-admintoken is required when the admin listener is a TCP address")
+	}
+	return net.Listen("tcp", addr)
+}
+
+var gAdminListener net.Listener
+
+func setupAdmin() {
+	ln, err := inheritedListener("admin")
+	if ln == nil && err == nil {
+		ln, err = listenAdmin(gAdminAddr)
+	}
+	if err != nil {
+		log.Fatalf("Unable to start admin listener on %s : %s", gAdminAddr, err)
+	}
+	gAdminListener = ln
+	log.Infof("Admin API listening on %v\n", ln.Addr())
+	srv := &http.Server{Handler: adminHandler(), ReadTimeout: 10 * time.Second, WriteTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Infof("ERR: admin listener on %v stopped: %v", ln.Addr(), err)
+		}
+	}()
+}
+
+func adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connections", adminGet(adminConnections))
+	mux.HandleFunc("/connections/kill", adminPost(adminKillConnection))
+	mux.HandleFunc("/upstreams", adminGet(adminUpstreams))
+	mux.HandleFunc("/upstreams/state", adminPost(adminUpstreamState))
+	mux.HandleFunc("/directs", adminGet(adminDirects))
+	mux.HandleFunc("/directs/add", adminPost(adminAddDirect))
+	mux.HandleFunc("/directs/remove", adminPost(adminRemoveDirect))
+	mux.HandleFunc("/reload", adminPost(adminReload))
+	mux.HandleFunc("/loglevel", adminPost(adminLogLevel))
+	return adminAuth(mux)
+}
+
+func adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if gAdminToken != "" {
+			h := r.Header.Get("Authorization")
+			token := strings.TrimPrefix(h, "Bearer ")
+			if !strings.HasPrefix(h, "Bearer ") || subtle.ConstantTimeCompare([]byte(token), []byte(gAdminToken)) != 1 {
+				log.Infof("ADMIN|%v|%s %s|ERR: bad or missing token", r.RemoteAddr, r.Method, r.URL.Path)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		log.Debugf("ADMIN|%v|%s %s", r.RemoteAddr, r.Method, r.URL)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func adminGet(h http.HandlerFunc) http.HandlerFunc {
+	return adminMethod("GET", h)
+}
+
+func adminPost(h http.HandlerFunc) http.HandlerFunc {
+	return adminMethod("POST", h)
+}
+
+func adminMethod(method string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func adminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func adminOK(w http.ResponseWriter) {
+	adminJSON(w, map[string]string{"result": "ok"})
+}
+
+func adminConnections(w http.ResponseWriter, r *http.Request) {
+	tunnels := activeTunnels()
+	ret := make([]adminTunnel, 0, len(tunnels))
+	for _, t := range tunnels {
+		a := adminTunnel{
+			ID:      t.id,
+			Client:  fmt.Sprintf("%v", t.client.RemoteAddr()),
+			Dst:     t.dst,
+			Via:     t.via,
+			Started: t.started.Format(time.RFC3339),
+			Age:     time.Since(t.started).Truncate(time.Second).String(),
+		}
+		if p := t.clientPeek(); p != nil {
+			a.Protocol = p.protocol
+			if p.hello != nil {
+				a.JA3, a.JA4 = p.hello.ja3(), p.hello.ja4()
+			}
+		}
+		ret = append(ret, a)
+	}
+	adminJSON(w, ret)
+}
+
+func adminKillConnection(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "id must be a connection id", http.StatusBadRequest)
+		return
+	}
+	if !closeTunnel(id) {
+		http.Error(w, "no such connection", http.StatusNotFound)
+		return
+	}
+	log.Infof("ADMIN|%v|Killed connection %d", r.RemoteAddr, id)
+	adminOK(w)
+}
+
+func adminUpstreams(w http.ResponseWriter, r *http.Request) {
+	counts := make(map[string]int)
+	for _, t := range activeTunnels() {
+		counts[t.via]++
+	}
+	upstreams := currentConfig().upstreams()
+	ret := make([]adminUpstream, 0, len(upstreams))
+	for _, spec := range upstreams {
+		ret = append(ret, adminUpstream{Upstream: spec, State: upstreamState(spec), Tunnels: counts[spec]})
+	}
+	adminJSON(w, ret)
+}
+
+func adminUpstreamState(w http.ResponseWriter, r *http.Request) {
+	if err := setUpstreamState(r.FormValue("upstream"), r.FormValue("state")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	adminOK(w)
+}
+
+func adminDirects(w http.ResponseWriter, r *http.Request) {
+	directs := currentConfig().directs
+	if directs == nil {
+		directs = []string{}
+	}
+	adminJSON(w, directs)
+}
+
+func adminAddDirect(w http.ResponseWriter, r *http.Request) {
+	if err := addDirect(r.FormValue("direct")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	adminOK(w)
+}
+
+func adminRemoveDirect(w http.ResponseWriter, r *http.Request) {
+	if err := removeDirect(r.FormValue("direct")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	adminOK(w)
+}
+
+func adminReload(w http.ResponseWriter, r *http.Request) {
+	if err := reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	adminOK(w)
+}
+
+func adminLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.FormValue("level") {
+	case "debug":
+		log.SetLevel(log.DEBUG)
+	case "info":
+		log.SetLevel(log.INFO)
+	default:
+		http.Error(w, "level must be debug or info", http.StatusBadRequest)
+		return
+	}
+	log.Infof("ADMIN|%v|Log level set to %s", r.RemoteAddr, r.FormValue("level"))
+	adminOK(w)
+}
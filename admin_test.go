@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func adminRequest(t *testing.T, method, target, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	adminHandler().ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminToken(t *testing.T) {
+	gAdminToken = "s3cret"
+	defer func() { gAdminToken = "" }()
+	cfg, _ := newProxyConfig([]string{"10.1.1.1:3128"}, nil, nil)
+	setConfig(cfg)
+
+	if w := adminRequest(t, "GET", "/upstreams", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("request without token returned %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if w := adminRequest(t, "GET", "/upstreams", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("request with wrong token returned %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if w := adminRequest(t, "GET", "/upstreams", "s3cret"); w.Code != http.StatusOK {
+		t.Errorf("request with token returned %d, want %d", w.Code, http.StatusOK)
+	}
+	for _, h := range []string{"s3cret", "Basic s3cret"} {
+		req := httptest.NewRequest("GET", "/upstreams", nil)
+		req.Header.Set("Authorization", h)
+		w := httptest.NewRecorder()
+		adminHandler().ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("request with Authorization %q returned %d, want %d", h, w.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestAdminDirects(t *testing.T) {
+	cfg, _ := newProxyConfig([]string{"10.1.1.1:3128"}, nil, []string{"1.2.3.4"})
+	setConfig(cfg)
+
+	if w := adminRequest(t, "POST", "/directs/add?direct=5.6.7.0/24", ""); w.Code != http.StatusOK {
+		t.Fatalf("adding a direct returned %d: %s", w.Code, w.Body)
+	}
+	ip := net.ParseIP("5.6.7.8")
+	if ok, _ := currentConfig().director(&ip); !ok {
+		t.Errorf("%s should go direct after adding 5.6.7.0/24", ip)
+	}
+
+	if w := adminRequest(t, "POST", "/directs/add?direct=5.6.7.0/99", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("adding an invalid CIDR returned %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	if w := adminRequest(t, "POST", "/directs/remove?direct=1.2.3.4", ""); w.Code != http.StatusOK {
+		t.Fatalf("removing a direct returned %d: %s", w.Code, w.Body)
+	}
+	ip = net.ParseIP("1.2.3.4")
+	if ok, _ := currentConfig().director(&ip); ok {
+		t.Errorf("%s should be proxied after removing it from the directs", ip)
+	}
+
+	w := adminRequest(t, "GET", "/directs", "")
+	if got := strings.TrimSpace(w.Body.String()); got != `["5.6.7.0/24"]` {
+		t.Errorf("GET /directs = %s, want [\"5.6.7.0/24\"]", got)
+	}
+
+	if w := adminRequest(t, "GET", "/directs/add?direct=8.8.8.8", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET on /directs/add returned %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestAdminUpstreamState(t *testing.T) {
+	cfg, _ := newProxyConfig([]string{"10.1.1.1:3128", "10.2.2.2:3128"}, nil, nil)
+	setConfig(cfg)
+	defer setUpstreamState("10.1.1.1:3128", upstreamUp)
+
+	if w := adminRequest(t, "POST", "/upstreams/state?upstream=10.1.1.1:3128&state=draining", ""); w.Code != http.StatusOK {
+		t.Fatalf("draining an upstream returned %d: %s", w.Code, w.Body)
+	}
+	if s := upstreamState("10.1.1.1:3128"); s != upstreamDraining {
+		t.Errorf("upstream state is %q, want %q", s, upstreamDraining)
+	}
+	if s := upstreamState("10.2.2.2:3128"); s != upstreamUp {
+		t.Errorf("other upstream state is %q, want %q", s, upstreamUp)
+	}
+	if w := adminRequest(t, "POST", "/upstreams/state?upstream=10.9.9.9:3128&state=down", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("setting the state of an unknown upstream returned %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	// upstreams of rules can be managed too
+	rules, err := loadRules(writeTestFile(t, "rules", "sni=a proxy 10.3.3.3:3128\nsni=b proxy 10.1.1.1:3128\n"), nil)
+	if err != nil {
+		t.Fatalf("loadRules(): %v", err)
+	}
+	setConfig(cfg.withRules(rules))
+	defer setUpstreamState("10.3.3.3:3128", upstreamUp)
+	if w := adminRequest(t, "POST", "/upstreams/state?upstream=10.3.3.3:3128&state=down", ""); w.Code != http.StatusOK {
+		t.Errorf("taking down the upstream of a rule returned %d: %s", w.Code, w.Body)
+	}
+	if s := upstreamState("10.3.3.3:3128"); s != upstreamDown {
+		t.Errorf("rule upstream state is %q, want %q", s, upstreamDown)
+	}
+	w := adminRequest(t, "GET", "/upstreams", "")
+	for _, spec := range []string{"10.1.1.1:3128", "10.2.2.2:3128", "10.3.3.3:3128"} {
+		if n := strings.Count(w.Body.String(), spec); n != 1 {
+			t.Errorf("GET /upstreams lists %s %d times: %s", spec, n, w.Body)
+		}
+	}
+}
+
+func TestProxyConnectionAllUpstreamsDraining(t *testing.T) {
+	cfg, _ := newProxyConfig([]string{"10.1.1.1:3128", "10.2.2.2:3128"}, nil, nil)
+	orig := currentConfig()
+	setConfig(cfg)
+	defer setConfig(orig)
+	for _, spec := range cfg.proxyServers {
+		if err := setUpstreamState(spec, upstreamDraining); err != nil {
+			t.Fatalf("setUpstreamState(): %v", err)
+		}
+		defer setUpstreamState(spec, upstreamUp)
+	}
+
+	client, clientSide := tcpPair(t)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if tun := handleProxyConnection(clientSide, "192.0.2.10", 443, nil, cfg.proxyServers); tun != nil {
+		t.Fatalf("handleProxyConnection() set up a tunnel through a draining upstream")
+	}
+	got, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("client connection was not closed: %v", err)
+	}
+	if !strings.HasPrefix(string(got), "HTTP/1.0 503 ") || !strings.Contains(string(got), "ERR_NO_PROXIES") {
+		t.Errorf("client got %q, want a 503 ERR_NO_PROXIES", got)
+	}
+}
+
+func TestAdminKillConnection(t *testing.T) {
+	c1, c2 := net.Pipe()
+	s1, s2 := net.Pipe()
+	defer c2.Close()
+	defer s2.Close()
+	tun := trackTunnel(c1, s1, "1.2.3.4:443", viaDirect)
+	defer untrackTunnel(tun)
+
+	w := adminRequest(t, "GET", "/connections", "")
+	if !strings.Contains(w.Body.String(), `"dst":"1.2.3.4:443"`) {
+		t.Errorf("GET /connections does not list the tunnel: %s", w.Body)
+	}
+	if w := adminRequest(t, "POST", "/connections/kill?id=999999", ""); w.Code != http.StatusNotFound {
+		t.Errorf("killing an unknown connection returned %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := adminRequest(t, "POST", fmt.Sprintf("/connections/kill?id=%d", tun.id), ""); w.Code != http.StatusOK {
+		t.Fatalf("killing a connection returned %d: %s", w.Code, w.Body)
+	}
+	if _, err := c2.Write([]byte("x")); err == nil {
+		t.Errorf("client side of a killed connection is still open")
+	}
+}
+
+func TestListenAdminSocketPath(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "admin.sock")
+	ln, err := listenAdmin("unix:" + path)
+	if err != nil {
+		t.Fatalf("listenAdmin(): %v", err)
+	}
+	// closing a unix listener removes its socket, so leave a stale one behind
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	ln, err = listenAdmin(path)
+	if err != nil {
+		t.Fatalf("listenAdmin() over a stale socket: %v", err)
+	}
+	ln.Close()
+
+	conf := filepath.Join(dir, "any_proxy.toml")
+	os.WriteFile(conf, []byte("[listen]\n"), 0644)
+	if ln, err := listenAdmin("unix:" + conf); err == nil {
+		ln.Close()
+		t.Errorf("listenAdmin() took over a regular file")
+	}
+	if b, err := os.ReadFile(conf); err != nil || string(b) != "[listen]\n" {
+		t.Errorf("listenAdmin() removed or changed %s: %v", conf, err)
+	}
+}
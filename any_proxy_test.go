@@ -28,13 +28,13 @@ func TestNilClientToHandleDirectConnection(t *testing.T) {
 	dirFuncs := buildDirectors(gDirects)
 	director = getDirector(dirFuncs)
 
-	handleDirectConnection(nil, ipv4, port)
+	handleDirectConnection(nil, ipv4, port, nil)
 }
 
 func TestNilClientToHandleProxyConnection(t *testing.T) {
 	var ipv4 string = "2.3.4.5"
 	var port uint16 = 8999
-	handleProxyConnection(nil, ipv4, port)
+	handleProxyConnection(nil, ipv4, port, nil, nil)
 }
 
 // when a &net.TCPConn{} is created, the underlying fd is set to nil.
@@ -62,7 +62,7 @@ func TestEmptyFdToHandleDirectConnection(t *testing.T) {
 
 	var c1 *net.TCPConn
 	c1 = &net.TCPConn{}
-	handleDirectConnection(c1, ipv4, port)
+	handleDirectConnection(c1, ipv4, port, nil)
 }
 
 func TestEmptyFdToHandleProxyConnection(t *testing.T) {
@@ -70,7 +70,7 @@ func TestEmptyFdToHandleProxyConnection(t *testing.T) {
 	var port uint16 = 8999
 	var c1 *net.TCPConn
 	c1 = &net.TCPConn{}
-	handleProxyConnection(c1, ipv4, port)
+	handleProxyConnection(c1, ipv4, port, nil, nil)
 }
 
 // Test if direct connections are working
@@ -0,0 +1,769 @@
+//
+// config.go - Reading and checking the configuration file
+//
+// Copyright (C) 2013 Ryan A. Chapman. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+//      this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+//      this list of conditions and the following disclaimer in the documentation
+//      and/or other materials provided with the distribution.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHORS
+// OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+// The -config file is either the original "flag value" format, one flag per
+// line, or, if its name ends in .toml or it starts with a [table], a TOML file
+// laid out in sections (see confSchema and any_proxy.toml.example). Either way
+// it comes down to flag values, so everything downstream of the flags is the
+// same, and flags given on the command line take precedence over the file.
+// That also means the sections mirror the flags: there is one listener and one
+// list of upstreams tried in order, and rules are read from their own file.
+// Groups of upstreams and per-listener settings would need the proxy itself to
+// support them first.
+//
+// Only the parts of TOML that a configuration needs are understood: tables,
+// arrays of tables, strings, integers, floats, booleans and arrays, which may
+// span lines. Every problem is reported with its line number.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/namsral/flag"
+)
+
+// What a setting in a TOML file has to be.
+const (
+	confString = iota
+	confBool
+	confInt
+	confFloat
+	confDuration
+	confList
+	confPortList
+)
+
+var confKindNames = []string{
+	confString:   "a string",
+	confBool:     "true or false",
+	confInt:      "an integer",
+	confFloat:    "a number",
+	confDuration: "a duration string (e.g. \"30s\")",
+	confList:     "a list of strings",
+	confPortList: "a list of port numbers",
+}
+
+type confKey struct {
+	flag string
+	kind int
+}
+
+// confSchema maps each table and key of a TOML configuration file to the
+// flag it sets. Upstream proxies are [[upstream]] tables, see confUpstream.
+var confSchema = map[string]map[string]confKey{
+	"listen": {
+		"address":     {"l", confString},
+		"reuseport":   {"reuseport", confBool},
+		"admin":       {"admin", confString},
+		"admin_token": {"admintoken", confString},
+		"user":        {"user", confString},
+		"group":       {"group", confString},
+		"keep_caps":   {"keepcaps", confList},
+	},
+	"proxy": {
+		"skip_upstream_check": {"s", confBool},
+		"relay_redirects":     {"r", confBool},
+		"reverse_lookups":     {"R", confBool},
+		"lookup_timeout":      {"lookuptimeout", confDuration},
+		"lookup_negative_ttl": {"lookupnegttl", confDuration},
+		"lookup_workers":      {"lookupworkers", confInt},
+		"lookup_ttl":          {"lookupttl", confDuration},
+		"lookup_cache_size":   {"lookupcachesize", confInt},
+		"lookup_cache_file":   {"lookupcachefile", confString},
+		"sni_parsing":         {"S", confBool},
+		"host_sniffing":       {"hostsniff", confBool},
+		"http_ports":          {"httpports", confPortList},
+		"classify":            {"classify", confBool},
+		"peek_timeout":        {"peektimeout", confDuration},
+		"verify_name":         {"verifyname", confString},
+		"verify_timeout":      {"verifytimeout", confDuration},
+		"relay":               {"relay", confString},
+		"credentials":         {"credentials", confString},
+	},
+	"dns": {
+		"listen":    {"dns", confString},
+		"resolvers": {"dnsupstream", confList},
+		"allow":     {"dnsallow", confList},
+	},
+	"rules": {
+		"direct": {"d", confList},
+		"file":   {"rules", confString},
+	},
+	"limits": {
+		"max_tunnels":    {"maxtunnels", confInt},
+		"max_per_client": {"maxperclient", confInt},
+		"max_per_dest":   {"maxperdest", confInt},
+		"client_mask":    {"clientmask", confInt},
+		"client_rate":    {"clientrate", confFloat},
+		"client_burst":   {"clientburst", confInt},
+		"over_limit":     {"overlimit", confString},
+	},
+	"timeouts": {
+		"drain":     {"drain", confDuration},
+		"idle":      {"idletimeout", confDuration},
+		"queue":     {"queuetimeout", confDuration},
+		"shed_idle": {"shedidle", confDuration},
+	},
+	"logging": {
+		"file":     {"f", confString},
+		"verbose":  {"v", confBool},
+		"sink":     {"logsink", confString},
+		"syslog":   {"syslog", confString},
+		"journald": {"journald", confString},
+		"max_size": {"logmaxsize", confInt},
+		"max_age":  {"logmaxage", confDuration},
+		"backups":  {"logbackups", confInt},
+		"compress": {"logcompress", confBool},
+	},
+	"stats": {
+		"file": {"stat", confString},
+	},
+}
+
+const confUpstream = "upstream"
+
+// Flags a configuration file can't set.
+var confNotSettable = map[string]bool{"config": true, "check-config": true}
+
+// confSetting is a flag value set by line of a configuration file.
+type confSetting struct {
+	line  int
+	key   string // as written in the file
+	flag  string
+	value string
+}
+
+type confError struct {
+	line int
+	msg  string
+}
+
+func (e confError) Error() string {
+	return fmt.Sprintf("%d: %s", e.line, e.msg)
+}
+
+// confCheckers check values beyond their type, so that mistakes are caught
+// with a line number rather than later on, or by buildDirectors panicking.
+var confCheckers = map[string]func(string) error{
+	"dnsallow": func(v string) error {
+		_, err := parseDNSAllow(v)
+		return err
+	},
+	"dnsupstream": func(v string) error {
+		_, err := parseResolvers(v)
+		return err
+	},
+	"httpports": func(v string) error {
+		_, err := parseHTTPPorts(v)
+		return err
+	},
+	"rules": func(v string) error {
+		_, err := loadRules(v, nil)
+		return err
+	},
+	"keepcaps": func(v string) error {
+		_, err := parseCaps(v)
+		return err
+	},
+	"d": func(v string) error {
+		for _, d := range splitDirects(v) {
+			if err := checkDirect(d); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	"p": func(v string) error {
+		if v == "" {
+			return nil
+		}
+		for _, spec := range strings.Split(v, ",") {
+			if _, err := parseUpstream(spec); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	"clientmask": func(v string) error {
+		if n, _ := strconv.Atoi(v); n < 0 || n > 32 {
+			return errors.New("must be between 0 and 32")
+		}
+		return nil
+	},
+	"overlimit": func(v string) error {
+		return checkOneOf(v, overLimitRefuse, overLimitQueue)
+	},
+	"relay":      checkRelayMode,
+	"verifyname": checkVerifyPolicy,
+	"logsink": func(v string) error {
+		return checkOneOf(v, "file", "syslog", "journald")
+	},
+}
+
+func checkOneOf(v string, allowed ...string) error {
+	for _, a := range allowed {
+		if v == a {
+			return nil
+		}
+	}
+	return fmt.Errorf("must be one of %s, not %q", strings.Join(allowed, ", "), v)
+}
+
+// checkFlagValue checks that value suits the type of the flag name.
+func checkFlagValue(name, value string) error {
+	f := flag.Lookup(name)
+	if f == nil {
+		return fmt.Errorf("unknown setting %s", name)
+	}
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return nil
+	}
+	var err error
+	switch getter.Get().(type) {
+	case int:
+		_, err = strconv.Atoi(value)
+	case float64:
+		_, err = strconv.ParseFloat(value, 64)
+	case time.Duration:
+		_, err = time.ParseDuration(value)
+	case bool:
+		_, err = strconv.ParseBool(value)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value %q", value)
+	}
+	return nil
+}
+
+// readConfigFile reads the configuration file at path, returning the flag
+// values it sets in order and every problem found with them.
+func readConfigFile(path string) ([]confSetting, []confError, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var settings []confSetting
+	var errs []confError
+	if isTOMLConfig(path, data) {
+		settings, errs = parseTOMLConfig(bytes.NewReader(data))
+	} else {
+		settings, errs = parseFlagConfig(bytes.NewReader(data))
+	}
+	for _, s := range settings {
+		if confNotSettable[s.flag] {
+			errs = append(errs, confError{s.line, fmt.Sprintf("%s can't be set in a configuration file", s.key)})
+			continue
+		}
+		if err := checkFlagValue(s.flag, s.value); err != nil {
+			errs = append(errs, confError{s.line, fmt.Sprintf("%s: %v", s.key, err)})
+			continue
+		}
+		if check := confCheckers[s.flag]; check != nil {
+			if err := check(s.value); err != nil {
+				errs = append(errs, confError{s.line, fmt.Sprintf("%s: %v", s.key, err)})
+			}
+		}
+	}
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].line < errs[j].line })
+	return settings, errs, nil
+}
+
+// isTOMLConfig tells the formats apart: a file of flags can't start with a
+// [table], and TOML settings are all in tables.
+func isTOMLConfig(path string, data []byte) bool {
+	if strings.HasSuffix(path, ".toml") {
+		return true
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && line[0] != '#' {
+			return line[0] == '['
+		}
+	}
+	return false
+}
+
+// parseFlagConfig reads the original format: "flag value" or "flag=value",
+// one per line, with # comments.
+func parseFlagConfig(r io.Reader) ([]confSetting, []confError) {
+	var settings []confSetting
+	var errs []confError
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		name, value := line, "true"
+		if i := strings.IndexAny(line, " \t="); i >= 0 {
+			name, value = line[:i], strings.TrimLeft(line[i+1:], " \t=")
+		}
+		if flag.Lookup(name) == nil {
+			errs = append(errs, confError{n, fmt.Sprintf("unknown setting %s", name)})
+			continue
+		}
+		settings = append(settings, confSetting{line: n, key: name, flag: name, value: value})
+	}
+	if err := sc.Err(); err != nil {
+		errs = append(errs, confError{0, err.Error()})
+	}
+	return settings, errs
+}
+
+type tomlUpstream struct {
+	line          int
+	address, auth string
+	addrLine      int
+}
+
+// parseTOMLConfig reads a TOML configuration file laid out as in confSchema.
+func parseTOMLConfig(r io.Reader) ([]confSetting, []confError) {
+	var settings []confSetting
+	var errs []confError
+	var upstreams []*tomlUpstream
+	table := ""
+	seenTables := make(map[string]int)
+	seenKeys := make(map[string]int)
+
+	sc := bufio.NewScanner(r)
+	n := 0
+	for sc.Scan() {
+		n++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if line[0] == '[' {
+			name, array, err := parseTOMLHeader(line)
+			if err != nil {
+				errs = append(errs, confError{n, err.Error()})
+				table = "?"
+				continue
+			}
+			table = name
+			switch {
+			case name == confUpstream && array:
+				upstreams = append(upstreams, &tomlUpstream{line: n})
+			case name == confUpstream:
+				errs = append(errs, confError{n, "upstream proxies are given as [[upstream]] tables"})
+				table = "?"
+			case confSchema[name] == nil:
+				errs = append(errs, confError{n, fmt.Sprintf("unknown table [%s]", name)})
+				table = "?"
+			case array:
+				errs = append(errs, confError{n, fmt.Sprintf("[%s] is a table, not an array of tables", name)})
+				table = "?"
+			case seenTables[name] != 0:
+				errs = append(errs, confError{n, fmt.Sprintf("[%s] already defined on line %d", name, seenTables[name])})
+				table = "?"
+			default:
+				seenTables[name] = n
+			}
+			continue
+		}
+
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			errs = append(errs, confError{n, fmt.Sprintf("expected key = value, got %q", line)})
+			continue
+		}
+		key := strings.TrimSpace(line[:eq])
+		start := n
+		text := line[eq+1:]
+		value, err := parseTOMLValue(text)
+		// an array may go on over several lines
+		for err == errTOMLUnterminated && sc.Scan() {
+			n++
+			text += "\n" + sc.Text()
+			value, err = parseTOMLValue(text)
+		}
+		if err != nil {
+			errs = append(errs, confError{start, fmt.Sprintf("%s: %v", key, err)})
+			continue
+		}
+		if !isTOMLBareKey(key) {
+			errs = append(errs, confError{start, fmt.Sprintf("invalid key %q", key)})
+			continue
+		}
+		if table == "?" {
+			// the table has already been reported
+			continue
+		}
+		fullKey := key
+		if table != "" {
+			fullKey = table + "." + key
+		}
+
+		if table == confUpstream {
+			u := upstreams[len(upstreams)-1]
+			s, ok := value.(string)
+			switch {
+			case key != "address" && key != "auth":
+				errs = append(errs, confError{start, fmt.Sprintf("unknown setting %s", fullKey)})
+			case !ok:
+				errs = append(errs, confError{start, fmt.Sprintf("%s must be %s", fullKey, confKindNames[confString])})
+			case key == "address":
+				u.address, u.addrLine = s, start
+			default:
+				u.auth = s
+			}
+			continue
+		}
+
+		k, ok := confSchema[table][key]
+		if !ok {
+			errs = append(errs, confError{start, fmt.Sprintf("unknown setting %s", fullKey)})
+			continue
+		}
+		if prev := seenKeys[fullKey]; prev != 0 {
+			errs = append(errs, confError{start, fmt.Sprintf("%s already set on line %d", fullKey, prev)})
+			continue
+		}
+		seenKeys[fullKey] = start
+		s, ok := tomlFlagValue(value, k.kind)
+		if !ok {
+			errs = append(errs, confError{start, fmt.Sprintf("%s must be %s", fullKey, confKindNames[k.kind])})
+			continue
+		}
+		settings = append(settings, confSetting{line: start, key: fullKey, flag: k.flag, value: s})
+	}
+	if err := sc.Err(); err != nil {
+		errs = append(errs, confError{n, err.Error()})
+	}
+
+	var specs []string
+	for _, u := range upstreams {
+		switch {
+		case u.address == "":
+			errs = append(errs, confError{u.line, "[[upstream]] has no address"})
+			continue
+		case strings.ContainsAny(u.address, ",@/"):
+			errs = append(errs, confError{u.addrLine, fmt.Sprintf("upstream.address %q is not host:port", u.address)})
+			continue
+		}
+		spec := u.address
+		if u.auth != "" {
+			// a URL, so that the credentials can hold anything. Commas would
+			// split -p, and url leaves them be.
+			user, password, _ := strings.Cut(u.auth, ":")
+			userinfo := strings.ReplaceAll(url.UserPassword(user, password).String(), ",", "%2C")
+			spec = "http://" + userinfo + "@" + u.address
+		}
+		if _, err := parseUpstream(spec); err != nil {
+			errs = append(errs, confError{u.addrLine, fmt.Sprintf("upstream.address: %v", err)})
+			continue
+		}
+		specs = append(specs, spec)
+	}
+	if len(specs) > 0 {
+		settings = append(settings, confSetting{line: upstreams[0].line, key: "upstream", flag: "p", value: strings.Join(specs, ",")})
+	}
+	return settings, errs
+}
+
+func parseTOMLHeader(line string) (name string, array bool, err error) {
+	end := strings.IndexByte(line, '#')
+	if end < 0 {
+		end = len(line)
+	}
+	h := strings.TrimSpace(line[:end])
+	array = strings.HasPrefix(h, "[[")
+	if array && strings.HasSuffix(h, "]]") {
+		name = strings.TrimSpace(h[2 : len(h)-2])
+	} else if !array && strings.HasSuffix(h, "]") {
+		name = strings.TrimSpace(h[1 : len(h)-1])
+	} else {
+		return "", false, fmt.Errorf("invalid table header %q", h)
+	}
+	if !isTOMLBareKey(name) {
+		return "", false, fmt.Errorf("invalid table name %q", name)
+	}
+	return name, array, nil
+}
+
+func isTOMLBareKey(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+var errTOMLUnterminated = errors.New("unterminated array")
+
+// parseTOMLValue parses the value of a key, and anything after it on the line
+// must be a comment. Values are string, int64, float64, bool or []interface{}.
+func parseTOMLValue(s string) (interface{}, error) {
+	v, rest, err := parseTOMLItem(s)
+	if err != nil {
+		return nil, err
+	}
+	rest = strings.TrimLeft(rest, " \t")
+	if rest != "" && rest[0] != '#' {
+		return nil, fmt.Errorf("unexpected %q after the value", rest)
+	}
+	return v, nil
+}
+
+func parseTOMLItem(s string) (interface{}, string, error) {
+	s = strings.TrimLeft(s, " \t")
+	if s == "" || s[0] == '\n' || s[0] == '#' {
+		return nil, "", errors.New("missing value")
+	}
+	switch s[0] {
+	case '"':
+		for i := 1; i < len(s) && s[i] != '\n'; i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				v, err := strconv.Unquote(s[:i+1])
+				if err != nil {
+					return nil, "", fmt.Errorf("invalid string %s", s[:i+1])
+				}
+				return v, s[i+1:], nil
+			}
+		}
+		return nil, "", errors.New("unterminated string")
+	case '\'':
+		if i := strings.IndexAny(s[1:], "'\n"); i >= 0 && s[1+i] == '\'' {
+			return s[1 : 1+i], s[2+i:], nil
+		}
+		return nil, "", errors.New("unterminated string")
+	case '[':
+		return parseTOMLArray(s[1:])
+	}
+
+	end := strings.IndexAny(s, " \t\n,]#")
+	if end < 0 {
+		end = len(s)
+	}
+	tok := s[:end]
+	switch tok {
+	case "true":
+		return true, s[end:], nil
+	case "false":
+		return false, s[end:], nil
+	}
+	num := strings.ReplaceAll(tok, "_", "")
+	if n, err := strconv.ParseInt(num, 10, 64); err == nil {
+		return n, s[end:], nil
+	}
+	if f, err := strconv.ParseFloat(num, 64); err == nil {
+		return f, s[end:], nil
+	}
+	return nil, "", fmt.Errorf("invalid value %q (strings must be quoted)", tok)
+}
+
+func parseTOMLArray(s string) (interface{}, string, error) {
+	var items []interface{}
+	for {
+		s = skipTOMLSpace(s)
+		if s == "" {
+			return nil, "", errTOMLUnterminated
+		}
+		if s[0] == ']' {
+			return items, s[1:], nil
+		}
+		v, rest, err := parseTOMLItem(s)
+		if err != nil {
+			return nil, "", err
+		}
+		items = append(items, v)
+		s = skipTOMLSpace(rest)
+		switch {
+		case s == "":
+			return nil, "", errTOMLUnterminated
+		case s[0] == ',':
+			s = s[1:]
+		case s[0] != ']':
+			return nil, "", fmt.Errorf("expected , or ] in array, got %q", s)
+		}
+	}
+}
+
+// skipTOMLSpace skips whitespace, newlines and comments inside an array.
+func skipTOMLSpace(s string) string {
+	for {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if s == "" || s[0] != '#' {
+			return s
+		}
+		i := strings.IndexByte(s, '\n')
+		if i < 0 {
+			return ""
+		}
+		s = s[i:]
+	}
+}
+
+// tomlFlagValue turns v into the value of a flag of the given kind.
+func tomlFlagValue(v interface{}, kind int) (string, bool) {
+	switch kind {
+	case confString:
+		s, ok := v.(string)
+		return s, ok
+	case confDuration:
+		s, ok := v.(string)
+		if _, err := time.ParseDuration(s); !ok || err != nil {
+			return "", false
+		}
+		return s, true
+	case confBool:
+		// the boolean flags are all -x=1
+		b, ok := v.(bool)
+		if b {
+			return "1", ok
+		}
+		return "0", ok
+	case confInt:
+		n, ok := v.(int64)
+		return strconv.FormatInt(n, 10), ok
+	case confFloat:
+		switch n := v.(type) {
+		case int64:
+			return strconv.FormatInt(n, 10), true
+		case float64:
+			return strconv.FormatFloat(n, 'g', -1, 64), true
+		}
+	case confList, confPortList:
+		items, ok := v.([]interface{})
+		if !ok {
+			return "", false
+		}
+		var list []string
+		for _, item := range items {
+			s, ok := item.(string)
+			if n, isInt := item.(int64); isInt && kind == confPortList {
+				s, ok = strconv.FormatInt(n, 10), true
+			}
+			if !ok || strings.Contains(s, ",") {
+				return "", false
+			}
+			list = append(list, s)
+		}
+		return strings.Join(list, ","), true
+	}
+	return "", false
+}
+
+// parseArgs parses args into fs, then sets whatever they left unset from
+// the -config file, if there is one.
+func parseArgs(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	path := fs.Lookup("config").Value.String()
+	if path == "" {
+		return nil
+	}
+	settings, errs, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		more := ""
+		if len(errs) > 1 {
+			more = fmt.Sprintf(" (and %d more, see -check-config)", len(errs)-1)
+		}
+		return fmt.Errorf("%s:%v%s", path, errs[0], more)
+	}
+	onCommandLine := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		onCommandLine[f.Name] = true
+	})
+	for _, s := range settings {
+		if onCommandLine[s.flag] {
+			continue
+		}
+		if err := fs.Set(s.flag, s.value); err != nil {
+			return fmt.Errorf("%s:%d: %s: %v", path, s.line, s.key, err)
+		}
+	}
+	return nil
+}
+
+// checkConfigFile returns every problem with the configuration file at path,
+// including ones that only show when its settings are taken together. The
+// upstream proxies aren't contacted.
+func checkConfigFile(path string) []string {
+	settings, errs, err := readConfigFile(path)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	var problems []string
+	for _, e := range errs {
+		problems = append(problems, fmt.Sprintf("%s:%v", path, e))
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+
+	vals := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		vals[f.Name] = f.DefValue
+	})
+	for _, s := range settings {
+		vals[s.flag] = s.value
+	}
+	vals["s"] = "1"
+	if _, err := loadConfig(vals); err != nil {
+		problems = append(problems, fmt.Sprintf("%s: %v", path, err))
+	}
+	return problems
+}
+
+// runCheckConfig is -check-config: it prints every problem with the file at
+// path and returns the exit status.
+func runCheckConfig(path string) int {
+	problems := checkConfigFile(path)
+	for _, p := range problems {
+		fmt.Fprintln(os.Stderr, p)
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	fmt.Fprintf(os.Stdout, "%s: OK\n", path)
+	return 0
+}
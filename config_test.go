@@ -0,0 +1,135 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExampleConfig(t *testing.T) {
+	if problems := checkConfigFile("any_proxy.toml.example"); len(problems) != 0 {
+		t.Errorf("example config has problems: %v", problems)
+	}
+	settings, _, _ := readConfigFile("any_proxy.toml.example")
+	got := make(map[string]string)
+	for _, s := range settings {
+		got[s.flag] = s.value
+	}
+	want := map[string]string{
+		"l":     ":3129",
+		"p":     "proxy1.example.com:8080,proxy2.example.com:3128",
+		"d":     "10.0.0.0/8,192.168.1.1",
+		"S":     "1",
+		"s":     "0",
+		"drain": "30s",
+	}
+	for flag, v := range want {
+		if got[flag] != v {
+			t.Errorf("-%s = %q, want %q", flag, got[flag], v)
+		}
+	}
+}
+
+func TestCheckConfigReportsEveryError(t *testing.T) {
+	path := writeTestFile(t, "any_proxy.toml", `# comment
+[listen]
+address = ":3129"
+port = 3129
+
+[limits]
+max_tunnels = "lots"
+over_limit = "drop"
+
+[rules]
+direct = ["10.0.0.0/8",
+          "1.2.3.0/99"]
+
+[nosuch]
+key = 1
+
+[[upstream]]
+auth = "user:pass"
+
+[timeouts]
+drain = 30s
+`)
+	problems := checkConfigFile(path)
+	want := []string{
+		path + ":4: unknown setting listen.port",
+		path + ":7: limits.max_tunnels must be an integer",
+		path + ":8: limits.over_limit: must be one of refuse, queue, not \"drop\"",
+		path + ":11: rules.direct: unable to parse CIDR string",
+		path + ":14: unknown table [nosuch]",
+		path + ":17: [[upstream]] has no address",
+		path + ":21: drain: invalid value \"30s\" (strings must be quoted)",
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("got %d problems, want %d:\n%s", len(problems), len(want), strings.Join(problems, "\n"))
+	}
+	for i := range want {
+		if !strings.HasPrefix(problems[i], want[i]) {
+			t.Errorf("problem %d = %q, want %q...", i, problems[i], want[i])
+		}
+	}
+}
+
+func TestCheckConfigAcrossSettings(t *testing.T) {
+	path := writeTestFile(t, "any_proxy.toml", "[limits]\nclient_rate = -1\n")
+	if problems := checkConfigFile(path); len(problems) != 1 || !strings.Contains(problems[0], "negative") {
+		t.Errorf("checkConfigFile() = %v, want negative limits reported", problems)
+	}
+}
+
+func TestFlagConfigLineNumbers(t *testing.T) {
+	path := writeTestFile(t, "any_proxy.conf", "# comment\np 10.1.1.1:3128\nS yes\nnosuchflag 1\nd 1.2.3.4\n")
+	problems := checkConfigFile(path)
+	want := []string{path + ":3: S: invalid value", path + ":4: unknown setting nosuchflag"}
+	if len(problems) != len(want) {
+		t.Fatalf("got problems %v, want %v", problems, want)
+	}
+	for i := range want {
+		if !strings.HasPrefix(problems[i], want[i]) {
+			t.Errorf("problem %d = %q, want %q...", i, problems[i], want[i])
+		}
+	}
+}
+
+func TestCommandLineOverridesConfig(t *testing.T) {
+	path := writeTestFile(t, "any_proxy.toml", "[proxy]\nsni_parsing = true\nrelay = \"epoll\"\n[[upstream]]\naddress = \"10.1.1.1:3128\"\n")
+	vals, err := parseFlagValues([]string{"-config", path, "-S", "0"})
+	if err != nil {
+		t.Fatalf("parseFlagValues() failed: %v", err)
+	}
+	if vals["S"] != "0" || vals["relay"] != "epoll" || vals["p"] != "10.1.1.1:3128" {
+		t.Errorf("S=%q relay=%q p=%q, want the -S from the command line and the rest from the file", vals["S"], vals["relay"], vals["p"])
+	}
+
+	bad := writeTestFile(t, "any_proxy.toml", "[proxy]\nrelay = \"threads\"\n")
+	if _, err := parseFlagValues([]string{"-config", bad}); err == nil || !strings.Contains(err.Error(), ":2: ") {
+		t.Errorf("parseFlagValues() = %v, want an error naming line 2", err)
+	}
+}
+
+func TestConfigUpstreamAuth(t *testing.T) {
+	path := writeTestFile(t, "any_proxy.toml", "[[upstream]]\naddress = \"10.1.1.1:3128\"\nauth = \"user:p@ss,w:rd\"\n")
+	settings, errs, _ := readConfigFile(path)
+	if len(errs) != 0 || len(settings) != 1 {
+		t.Fatalf("readConfigFile() = %v, %v", settings, errs)
+	}
+	_, auth, err := parseProxies(settings[0].value, nil, false)
+	if err != nil || auth["10.1.1.1:3128"] != basic("user:p@ss,w:rd") {
+		t.Errorf("parseProxies(%q) = %v, %v, want the credentials intact", redactUpstream(settings[0].value), auth, err)
+	}
+}
+
+func TestConfigPortList(t *testing.T) {
+	path := writeTestFile(t, "any_proxy.toml", "[proxy]\nhttp_ports = [80, \"8080\"]\n")
+	vals, err := parseFlagValues([]string{"-config", path})
+	if err != nil || vals["httpports"] != "80,8080" {
+		t.Errorf("http_ports = %q, %v, want 80,8080", vals["httpports"], err)
+	}
+	for _, bad := range []string{"[proxy]\nhttp_ports = [80.5]\n", "[proxy]\nhttp_ports = [70000]\n", "[listen]\nkeep_caps = [12]\n"} {
+		if problems := checkConfigFile(writeTestFile(t, "any_proxy.toml", bad)); len(problems) != 1 {
+			t.Errorf("checkConfigFile() of %q = %v, want one problem", bad, problems)
+		}
+	}
+}
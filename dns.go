@@ -0,0 +1,488 @@
+//
+// dns.go - DNS forwarder that remembers the names clients resolved
+//
+// Copyright (C) 2013 Ryan A. Chapman. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+//      this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+//      this list of conditions and the following disclaimer in the documentation
+//      and/or other materials provided with the distribution.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHORS
+// OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+// With -dns=ADDR, any_proxy answers DNS queries on ADDR, over UDP and TCP, by
+// passing them on unchanged to the resolvers in -dnsupstream, trying each in
+// turn. Every A and AAAA record in the answers is remembered in the reverse
+// lookup cache under the name the client asked for, for as long as the record's
+// TTL, so that when that client then connects to the address, the CONNECT
+// request names the host it meant rather than whatever a PTR lookup of the
+// address returns. Names are remembered per client, since two names can share
+// an address. Clients (or a DHCP server) have to be pointed at ADDR.
+//
+// Only clients in -dnsallow are answered. Without it, ADDR has to be a
+// loopback address, so that any_proxy isn't an open resolver.
+//
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	log "github.com/zdannar/flogger"
+)
+
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+
+	dnsHeaderLen = 12
+	dnsMaxMsgLen = 65535
+
+	// how long each resolver gets to answer
+	dnsTimeout = 2 * time.Second
+	// how long a TCP client can sit between queries
+	dnsTCPIdleTimeout = 30 * time.Second
+	// how many UDP queries are passed on at once, more are dropped and the
+	// clients retry
+	dnsMaxInflight = 1024
+)
+
+var gDNSListener net.Listener
+var gDNSConn net.PacketConn
+
+// dnsForwarder passes DNS queries on to resolvers and records the addresses
+// in their answers.
+type dnsForwarder struct {
+	resolvers []string
+	allow     []netip.Prefix // clients answered, all if empty
+	cache     *reverseLookupCache
+	timeout   time.Duration
+}
+
+// dnsRecord is an address from a DNS answer and how long it can be used for.
+type dnsRecord struct {
+	addr netip.Addr
+	ttl  time.Duration
+}
+
+// parseResolvers parses a -dnsupstream list of resolver IP addresses, which
+// may have a port, 53 otherwise.
+func parseResolvers(spec string) ([]string, error) {
+	var resolvers []string
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if ap, err := netip.ParseAddrPort(s); err == nil {
+			resolvers = append(resolvers, ap.String())
+			continue
+		}
+		addr, err := netip.ParseAddr(strings.Trim(s, "[]"))
+		if err != nil {
+			return nil, fmt.Errorf("resolver %q is not an IP address or IP:port", s)
+		}
+		resolvers = append(resolvers, netip.AddrPortFrom(addr, 53).String())
+	}
+	if len(resolvers) == 0 {
+		return nil, errors.New("no resolvers given")
+	}
+	return resolvers, nil
+}
+
+// parseDNSAllow parses a -dnsallow list of client networks, which may also be
+// single addresses.
+func parseDNSAllow(spec string) ([]netip.Prefix, error) {
+	var allow []netip.Prefix
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(s); err == nil {
+			allow = append(allow, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a network or IP address", s)
+		}
+		allow = append(allow, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return allow, nil
+}
+
+// allowed reports whether queries from client are answered.
+func (f *dnsForwarder) allowed(client netip.Addr) bool {
+	if len(f.allow) == 0 {
+		return true
+	}
+	client = client.Unmap()
+	for _, prefix := range f.allow {
+		if prefix.Contains(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLoopback reports whether a is a loopback address, which only local
+// clients can reach.
+func isLoopback(a net.Addr) bool {
+	ap, err := netip.ParseAddrPort(a.String())
+	return err == nil && ap.Addr().Unmap().IsLoopback()
+}
+
+// setupDNS starts the DNS forwarder on -dns, or on the sockets passed down by
+// the process we were upgraded from or by systemd.
+func setupDNS() {
+	resolvers, err := parseResolvers(gDNSUpstreams)
+	if err != nil {
+		log.Fatalf("Invalid -dnsupstream : %s", err)
+	}
+	allow, err := parseDNSAllow(gDNSAllow)
+	if err != nil {
+		log.Fatalf("Invalid -dnsallow : %s", err)
+	}
+	conn, err := inheritedPacketConn("dnsudp")
+	if conn == nil && err == nil {
+		conn, err = net.ListenPacket("udp", gDNSAddr)
+	}
+	if err != nil {
+		log.Fatalf("Unable to start DNS forwarder on udp %s : %s", gDNSAddr, err)
+	}
+	ln, err := inheritedListener("dns")
+	if ln == nil && err == nil {
+		ln, err = net.Listen("tcp", gDNSAddr)
+	}
+	if err != nil {
+		log.Fatalf("Unable to start DNS forwarder on tcp %s : %s", gDNSAddr, err)
+	}
+	if len(allow) == 0 && !(isLoopback(conn.LocalAddr()) && isLoopback(ln.Addr())) {
+		log.Fatalf("Invalid -dns : %v and %v would answer anyone, give -dnsallow or use a loopback address", conn.LocalAddr(), ln.Addr())
+	}
+	gDNSConn, gDNSListener = conn, ln
+	setupReverseLookups()
+	f := &dnsForwarder{resolvers: resolvers, allow: allow, cache: gReverseLookupCache, timeout: dnsTimeout}
+	log.Infof("DNS forwarder listening on %v and %v, resolving with %s\n", conn.LocalAddr(), ln.Addr(), strings.Join(resolvers, ","))
+	go f.serveUDP(conn)
+	go f.serveTCP(ln)
+}
+
+func (f *dnsForwarder) serveUDP(conn net.PacketConn) {
+	inflight := make(chan bool, dnsMaxInflight)
+	for {
+		buf := make([]byte, dnsMaxMsgLen)
+		n, client, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Infof("ERR: DNS forwarder on %v stopped: %v", conn.LocalAddr(), err)
+			}
+			return
+		}
+		addr := client.(*net.UDPAddr).AddrPort().Addr()
+		if !f.allowed(addr) {
+			log.Debugf("DNS|%v|Client not in -dnsallow, dropping", client)
+			incrDNSRefused()
+			continue
+		}
+		select {
+		case inflight <- true:
+		default:
+			log.Debugf("DNS|%v|Too many queries in flight, dropping", client)
+			continue
+		}
+		go func() {
+			defer func() { <-inflight }()
+			resp, err := f.forward(buf[:n], "udp", addr)
+			if err != nil {
+				log.Infof("DNS|%v|ERR: %v", client, err)
+				return
+			}
+			conn.WriteTo(resp, client)
+		}()
+	}
+}
+
+func (f *dnsForwarder) serveTCP(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// such as running out of file descriptors, which passes
+			log.Infof("ERR: DNS forwarder on %v could not accept: %v", ln.Addr(), err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go f.handleTCP(c)
+	}
+}
+
+// handleTCP answers queries from a TCP client until it hangs up or goes idle.
+func (f *dnsForwarder) handleTCP(c net.Conn) {
+	defer c.Close()
+	client := c.RemoteAddr().(*net.TCPAddr).AddrPort().Addr()
+	if !f.allowed(client) {
+		log.Debugf("DNS|%v|Client not in -dnsallow, closing", c.RemoteAddr())
+		incrDNSRefused()
+		return
+	}
+	for {
+		c.SetReadDeadline(time.Now().Add(dnsTCPIdleTimeout))
+		query, err := readDNSTCP(c)
+		if err != nil {
+			return
+		}
+		resp, err := f.forward(query, "tcp", client)
+		if err != nil {
+			log.Infof("DNS|%v|ERR: %v", c.RemoteAddr(), err)
+			return
+		}
+		c.SetWriteDeadline(time.Now().Add(f.timeout))
+		if err := writeDNSTCP(c, resp); err != nil {
+			return
+		}
+	}
+}
+
+// forward passes query on to the resolvers in turn over network until one
+// answers, records the addresses in the answer for client and returns it.
+func (f *dnsForwarder) forward(query []byte, network string, client netip.Addr) ([]byte, error) {
+	if len(query) < dnsHeaderLen {
+		return nil, errors.New("query too short")
+	}
+	incrDNSQueries()
+	var err error
+	for _, r := range f.resolvers {
+		var resp []byte
+		resp, err = f.exchange(query, network, r)
+		if err != nil {
+			log.Debugf("DNS|%s|Resolver failed: %v, trying next resolver", r, err)
+			continue
+		}
+		f.record(client, resp)
+		return resp, nil
+	}
+	incrDNSUpstreamErrors()
+	return nil, fmt.Errorf("no resolver answered: %v", err)
+}
+
+// exchange sends query to resolver and returns its response.
+func (f *dnsForwarder) exchange(query []byte, network, resolver string) ([]byte, error) {
+	c, err := net.DialTimeout(network, resolver, f.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(f.timeout))
+	if network == "tcp" {
+		if err := writeDNSTCP(c, query); err != nil {
+			return nil, err
+		}
+		resp, err := readDNSTCP(c)
+		if err != nil {
+			return nil, err
+		}
+		if len(resp) < dnsHeaderLen || resp[0] != query[0] || resp[1] != query[1] {
+			return nil, errors.New("response does not match query")
+		}
+		return resp, nil
+	}
+	if _, err := c.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dnsMaxMsgLen)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// ignore stray datagrams, such as late answers to an earlier query
+		if n >= dnsHeaderLen && buf[0] == query[0] && buf[1] == query[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+// record stores the addresses in resp in the cache as names client resolved,
+// for their TTL. Records with a TTL of 0 aren't to be cached, so they aren't.
+func (f *dnsForwarder) record(client netip.Addr, resp []byte) {
+	name, records, err := dnsAddresses(resp)
+	if err != nil {
+		log.Debugf("DNS|Not recording answer: %v", err)
+		return
+	}
+	for _, rec := range records {
+		if rec.ttl <= 0 {
+			continue
+		}
+		f.cache.storeClient(client, rec.addr, name, rec.ttl)
+		incrDNSAddressesRecorded()
+		log.Debugf("DNS|%v|Recorded %v as %s for %v", client, rec.addr, name, rec.ttl)
+	}
+}
+
+func readDNSTCP(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeDNSTCP(w io.Writer, msg []byte) error {
+	if len(msg) > dnsMaxMsgLen {
+		return errors.New("message too long")
+	}
+	buf := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(msg)), uint16(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
+
+// dnsAddresses returns the name asked about in the DNS response msg and the
+// A and AAAA records in its answer section, which also covers the names a
+// CNAME chain leads to.
+func dnsAddresses(msg []byte) (string, []dnsRecord, error) {
+	if len(msg) < dnsHeaderLen {
+		return "", nil, errors.New("message too short")
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&0x8000 == 0 {
+		return "", nil, errors.New("not a response")
+	}
+	if rcode := flags & 0xf; rcode != 0 {
+		return "", nil, fmt.Errorf("response code %d", rcode)
+	}
+	if qd := binary.BigEndian.Uint16(msg[4:]); qd != 1 {
+		return "", nil, fmt.Errorf("%d questions", qd)
+	}
+	an := int(binary.BigEndian.Uint16(msg[6:]))
+
+	name, off, err := readDNSName(msg, dnsHeaderLen)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := checkHostname(name); err != nil {
+		return "", nil, err
+	}
+	off += 4 // qtype, qclass
+
+	var records []dnsRecord
+	for i := 0; i < an; i++ {
+		if _, off, err = readDNSName(msg, off); err != nil {
+			return "", nil, err
+		}
+		if off+10 > len(msg) {
+			return "", nil, errors.New("answer truncated")
+		}
+		typ := binary.BigEndian.Uint16(msg[off:])
+		class := binary.BigEndian.Uint16(msg[off+2:])
+		ttl := binary.BigEndian.Uint32(msg[off+4:])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return "", nil, errors.New("answer truncated")
+		}
+		rdata := msg[off : off+rdlen]
+		off += rdlen
+		if class != dnsClassIN {
+			continue
+		}
+		var addr netip.Addr
+		switch {
+		case typ == dnsTypeA && rdlen == 4:
+			addr = netip.AddrFrom4([4]byte(rdata))
+		case typ == dnsTypeAAAA && rdlen == 16:
+			addr = netip.AddrFrom16([16]byte(rdata))
+		default:
+			continue
+		}
+		// TTLs with the top bit set are treated as 0 (RFC 2181)
+		if ttl > 1<<31-1 {
+			ttl = 0
+		}
+		records = append(records, dnsRecord{addr: addr, ttl: time.Duration(ttl) * time.Second})
+	}
+	return name, records, nil
+}
+
+// readDNSName reads the possibly compressed name at off in msg, returning it
+// without the trailing dot and the offset just past it.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errors.New("name truncated")
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, "."), end, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, errors.New("name truncated")
+			}
+			if jumps++; jumps > 16 {
+				return "", 0, errors.New("name has a compression loop")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		case l&0xc0 != 0:
+			return "", 0, fmt.Errorf("unknown label type %#x", l&0xc0)
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errors.New("name truncated")
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+// checkHostname makes sure name is a hostname that can go in a CONNECT
+// request as it is.
+func checkHostname(name string) error {
+	if name == "" || len(name) > 253 {
+		return fmt.Errorf("%q is not a hostname", name)
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return fmt.Errorf("%q is not a hostname", name)
+		}
+	}
+	return nil
+}
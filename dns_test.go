@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func appendDNSName(b []byte, name string) []byte {
+	for _, l := range strings.Split(name, ".") {
+		b = append(b, byte(len(l)))
+		b = append(b, l...)
+	}
+	return append(b, 0)
+}
+
+func dnsQuery(id uint16, name string) []byte {
+	b := binary.BigEndian.AppendUint16(nil, id)
+	b = append(b, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0)
+	b = appendDNSName(b, name)
+	return append(b, 0, dnsTypeA, 0, dnsClassIN)
+}
+
+type testRR struct {
+	typ   uint16
+	ttl   uint32
+	rdata []byte
+}
+
+// dnsResponse answers query with rrs, all owned by the name asked about,
+// which is referred to with a compression pointer. Anything after the
+// question, such as an EDNS0 record, is left out.
+func dnsResponse(query []byte, rcode byte, rrs ...testRR) []byte {
+	_, end, _ := readDNSName(query, dnsHeaderLen)
+	b := append([]byte(nil), query[:end+4]...)
+	binary.BigEndian.PutUint32(b[8:], 0)
+	b[2] |= 0x80
+	b[3] = 0x80 | rcode
+	binary.BigEndian.PutUint16(b[6:], uint16(len(rrs)))
+	for _, rr := range rrs {
+		b = append(b, 0xc0, dnsHeaderLen)
+		b = binary.BigEndian.AppendUint16(b, rr.typ)
+		b = binary.BigEndian.AppendUint16(b, dnsClassIN)
+		b = binary.BigEndian.AppendUint32(b, rr.ttl)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(rr.rdata)))
+		b = append(b, rr.rdata...)
+	}
+	return b
+}
+
+var testAnswers = []testRR{
+	{5, 300, appendDNSName(nil, "cdn.example.net")},
+	{dnsTypeA, 300, []byte{10, 1, 2, 3}},
+	{dnsTypeAAAA, 1 << 31, netip.MustParseAddr("2001:db8::1").AsSlice()},
+}
+
+func TestDNSAddresses(t *testing.T) {
+	resp := dnsResponse(dnsQuery(7, "www.Example.com"), 0, testAnswers...)
+	name, recs, err := dnsAddresses(resp)
+	if err != nil {
+		t.Fatalf("dnsAddresses(): %v", err)
+	}
+	if name != "www.Example.com" {
+		t.Errorf("name = %q, want www.Example.com", name)
+	}
+	want := []dnsRecord{
+		{netip.MustParseAddr("10.1.2.3"), 300 * time.Second},
+		{netip.MustParseAddr("2001:db8::1"), 0},
+	}
+	if len(recs) != len(want) || recs[0] != want[0] || recs[1] != want[1] {
+		t.Errorf("records = %v, want %v", recs, want)
+	}
+
+	bad := map[string][]byte{
+		"query":            dnsQuery(7, "www.example.com"),
+		"NXDOMAIN":         dnsResponse(dnsQuery(7, "www.example.com"), 3),
+		"CRLF in name":     dnsResponse(dnsQuery(7, "a\r\nX-Evil: 1.example.com"), 0, testAnswers[1]),
+		"space in name":    dnsResponse(dnsQuery(7, "a b.example.com"), 0, testAnswers[1]),
+		"truncated answer": dnsResponse(dnsQuery(7, "www.example.com"), 0, testAnswers...)[:50],
+		"short":            {0, 7, 0x80},
+	}
+	loop := dnsResponse(dnsQuery(7, "www.example.com"), 0, testAnswers[1])
+	loop[len(dnsQuery(7, "www.example.com"))+1] = byte(len(dnsQuery(7, "www.example.com")))
+	bad["compression loop"] = loop
+	for what, msg := range bad {
+		if _, _, err := dnsAddresses(msg); err == nil {
+			t.Errorf("dnsAddresses() of %s did not fail", what)
+		}
+	}
+}
+
+func TestParseResolvers(t *testing.T) {
+	got, err := parseResolvers("10.1.1.53, 10.2.2.53:5353,::1,[2001:db8::53]:53")
+	want := "10.1.1.53:53,10.2.2.53:5353,[::1]:53,[2001:db8::53]:53"
+	if err != nil || strings.Join(got, ",") != want {
+		t.Errorf("parseResolvers() = %v, %v, want %s", got, err, want)
+	}
+	for _, spec := range []string{"", "dns.example.com", "10.1.1.53:x"} {
+		if _, err := parseResolvers(spec); err == nil {
+			t.Errorf("parseResolvers(%q) did not fail", spec)
+		}
+	}
+}
+
+func TestParseDNSAllow(t *testing.T) {
+	allow, err := parseDNSAllow("10.1.2.3/8, 192.168.1.5,2001:db8::/32")
+	if err != nil {
+		t.Fatalf("parseDNSAllow(): %v", err)
+	}
+	f := &dnsForwarder{allow: allow}
+	for addr, want := range map[string]bool{
+		"10.200.0.1":        true,
+		"::ffff:10.200.0.1": true,
+		"192.168.1.5":       true,
+		"192.168.1.6":       false,
+		"2001:db8:1::1":     true,
+		"127.0.0.1":         false,
+		"2001:db9::1":       false,
+	} {
+		if got := f.allowed(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("allowed(%s) = %v, want %v", addr, got, want)
+		}
+	}
+	if _, err := parseDNSAllow("10.0.0.0/33"); err == nil {
+		t.Errorf("parseDNSAllow() of a bad network did not fail")
+	}
+	if allow, err := parseDNSAllow(""); allow != nil || err != nil {
+		t.Errorf("parseDNSAllow(\"\") = %v, %v, want everyone allowed", allow, err)
+	}
+}
+
+// startFakeResolver answers every query with rrs, on the same port over UDP
+// and TCP.
+func startFakeResolver(t *testing.T, rrs ...testRR) string {
+	answer := func(q []byte) []byte { return dnsResponse(q, 0, rrs...) }
+	for tries := 0; ; tries++ {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("could not listen: %v", err)
+		}
+		ln, err := net.Listen("tcp", pc.LocalAddr().String())
+		if err != nil {
+			pc.Close()
+			if tries < 10 {
+				continue
+			}
+			t.Fatalf("could not listen: %v", err)
+		}
+		t.Cleanup(func() { pc.Close(); ln.Close() })
+		go func() {
+			buf := make([]byte, dnsMaxMsgLen)
+			for {
+				n, addr, err := pc.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				// a stray datagram first, which must be ignored
+				pc.WriteTo([]byte{buf[0] + 1, buf[1], 0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0}, addr)
+				pc.WriteTo(answer(buf[:n]), addr)
+			}
+		}()
+		go func() {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				q, err := readDNSTCP(c)
+				if err == nil {
+					writeDNSTCP(c, answer(q))
+				}
+				c.Close()
+			}
+		}()
+		return pc.LocalAddr().String()
+	}
+}
+
+func TestDNSForwarder(t *testing.T) {
+	// nothing listens on a port just closed, so the first resolver fails
+	dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	dead.Close()
+	f := &dnsForwarder{
+		resolvers: []string{dead.LocalAddr().String(), startFakeResolver(t, testAnswers...)},
+		cache:     NewReverseLookupCache(defaultLookupCacheSize, defaultLookupTTL),
+		timeout:   time.Second,
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer pc.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer ln.Close()
+	go f.serveUDP(pc)
+	go f.serveTCP(ln)
+
+	uc, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("could not dial: %v", err)
+	}
+	defer uc.Close()
+	uc.SetDeadline(time.Now().Add(5 * time.Second))
+	uc.Write(dnsQuery(0x1234, "www.example.com"))
+	buf := make([]byte, dnsMaxMsgLen)
+	n, err := uc.Read(buf)
+	if err != nil {
+		t.Fatalf("no answer over UDP: %v", err)
+	}
+	if binary.BigEndian.Uint16(buf) != 0x1234 || buf[2]&0x80 == 0 || n < len(dnsQuery(0, "www.example.com")) {
+		t.Errorf("bad answer over UDP: %x", buf[:n])
+	}
+	client := netip.MustParseAddr("127.0.0.1")
+	if got, _ := f.cache.lookupClient(client, netip.MustParseAddr("10.1.2.3")); got != "www.example.com" {
+		t.Errorf("10.1.2.3 recorded as %q, want www.example.com", got)
+	}
+	// its TTL is 0
+	if got, ok := f.cache.lookupClient(client, netip.MustParseAddr("2001:db8::1")); ok {
+		t.Errorf("2001:db8::1 recorded as %q", got)
+	}
+	// the name is what this client resolved, not what everyone did
+	if got, ok := f.cache.lookupClient(netip.MustParseAddr("127.0.0.2"), netip.MustParseAddr("10.1.2.3")); ok {
+		t.Errorf("10.1.2.3 recorded as %q for another client", got)
+	}
+	if got, ok := f.cache.lookup(netip.MustParseAddr("10.1.2.3")); ok {
+		t.Errorf("10.1.2.3 recorded as %q for PTR lookups", got)
+	}
+
+	tc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("could not dial: %v", err)
+	}
+	defer tc.Close()
+	tc.SetDeadline(time.Now().Add(5 * time.Second))
+	writeDNSTCP(tc, dnsQuery(0x4321, "mail.example.com"))
+	resp, err := readDNSTCP(tc)
+	if err != nil {
+		t.Fatalf("no answer over TCP: %v", err)
+	}
+	if binary.BigEndian.Uint16(resp) != 0x4321 {
+		t.Errorf("bad answer over TCP: %x", resp)
+	}
+	if got, _ := f.cache.lookupClient(client, netip.MustParseAddr("10.1.2.3")); got != "mail.example.com" {
+		t.Errorf("10.1.2.3 recorded as %q, want mail.example.com", got)
+	}
+}
+
+func TestDNSForwarderAllow(t *testing.T) {
+	f := &dnsForwarder{
+		resolvers: []string{startFakeResolver(t, testAnswers...)},
+		allow:     []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		cache:     NewReverseLookupCache(defaultLookupCacheSize, defaultLookupTTL),
+		timeout:   time.Second,
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer pc.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer ln.Close()
+	go f.serveUDP(pc)
+	go f.serveTCP(ln)
+
+	uc, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("could not dial: %v", err)
+	}
+	defer uc.Close()
+	uc.SetDeadline(time.Now().Add(200 * time.Millisecond))
+	uc.Write(dnsQuery(0x1234, "www.example.com"))
+	if n, err := uc.Read(make([]byte, dnsMaxMsgLen)); err == nil {
+		t.Errorf("client not in -dnsallow got a %d byte answer over UDP", n)
+	}
+
+	tc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("could not dial: %v", err)
+	}
+	defer tc.Close()
+	tc.SetDeadline(time.Now().Add(5 * time.Second))
+	writeDNSTCP(tc, dnsQuery(0x4321, "www.example.com"))
+	if resp, err := readDNSTCP(tc); err == nil {
+		t.Errorf("client not in -dnsallow got an answer over TCP: %x", resp)
+	}
+}
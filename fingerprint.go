@@ -0,0 +1,184 @@
+//
+// fingerprint.go - JA3 and JA4 fingerprints of TLS clients
+//
+// Copyright (C) 2013 Ryan A. Chapman. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+//      this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+//      this list of conditions and the following disclaimer in the documentation
+//      and/or other materials provided with the distribution.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHORS
+// OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+// The ClientHello a TLS client sends depends on its TLS library and how that
+// is set up far more than on the server it wants, so a digest of it tells
+// browsers, tools and malware apart. Both common ones are computed from the
+// ClientHello decoded by sni.go:
+//
+// JA3 (https://github.com/salesforce/ja3) is the MD5 of the ClientHello
+// version, cipher suites, extensions, groups and point formats in the order
+// sent.
+//
+// JA4 (https://github.com/FoxIO-LLC/ja4) is "t13d1516h2_xxxxxxxxxxxx_yyyyyyyyyyyy":
+// the highest version offered, whether there is an SNI, the number of cipher
+// suites and extensions and the first ALPN protocol, then truncated SHA256s of
+// the sorted cipher suites and of the sorted extensions and the signature
+// algorithms. The sorting makes it stable across clients that shuffle their
+// extensions.
+//
+// GREASE values are left out of both.
+//
+
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ja3String returns the string that the JA3 fingerprint is the MD5 of.
+func (h *clientHello) ja3String() string {
+	return fmt.Sprintf("%d,%s,%s,%s,%s", h.version,
+		joinDecimal(withoutGREASE(h.cipherSuites)),
+		joinDecimal(withoutGREASE(h.extensions)),
+		joinDecimal(withoutGREASE(h.supportedGroups)),
+		joinDecimal(h.pointFormats))
+}
+
+// ja3 returns the JA3 fingerprint of the ClientHello.
+func (h *clientHello) ja3() string {
+	sum := md5.Sum([]byte(h.ja3String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// ja4 returns the JA4 fingerprint of the ClientHello.
+func (h *clientHello) ja4() string {
+	ciphers := withoutGREASE(h.cipherSuites)
+	extensions := withoutGREASE(h.extensions)
+
+	sni := "i"
+	for _, e := range extensions {
+		if e == extServerName {
+			sni = "d"
+		}
+	}
+	a := fmt.Sprintf("t%s%s%02d%02d%s", ja4Version(h.maxVersion()), sni, upTo99(len(ciphers)), upTo99(len(extensions)), ja4ALPN(h.alpn))
+
+	b := "000000000000"
+	if len(ciphers) > 0 {
+		b = ja4Hash(joinHex(sorted(ciphers)))
+	}
+
+	c := "000000000000"
+	if len(extensions) > 0 {
+		var rest []uint16
+		for _, e := range extensions {
+			if e != extServerName && e != extALPN {
+				rest = append(rest, e)
+			}
+		}
+		s := joinHex(sorted(rest))
+		if len(h.signatureAlgorithms) > 0 {
+			s += "_" + joinHex(h.signatureAlgorithms)
+		}
+		c = ja4Hash(s)
+	}
+	return a + "_" + b + "_" + c
+}
+
+func upTo99(n int) int {
+	if n > 99 {
+		return 99
+	}
+	return n
+}
+
+func ja4Version(v uint16) string {
+	switch v {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	}
+	return "00"
+}
+
+// ja4ALPN returns the first and last characters of the first ALPN protocol,
+// or of its hex if those aren't letters or digits.
+func ja4ALPN(alpn []string) string {
+	if len(alpn) == 0 || alpn[0] == "" {
+		return "00"
+	}
+	p := alpn[0]
+	first, last := p[0], p[len(p)-1]
+	if isAlnum(first) && isAlnum(last) {
+		return string([]byte{first, last})
+	}
+	return hex.EncodeToString([]byte{first})[:1] + hex.EncodeToString([]byte{last})[1:]
+}
+
+func isAlnum(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func ja4Hash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:6])
+}
+
+func withoutGREASE(vals []uint16) []uint16 {
+	var ret []uint16
+	for _, v := range vals {
+		if !isGREASE(v) {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+func sorted(vals []uint16) []uint16 {
+	ret := append([]uint16(nil), vals...)
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
+func joinDecimal[T uint8 | uint16](vals []T) string {
+	s := make([]string, len(vals))
+	for i, v := range vals {
+		s[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(s, "-")
+}
+
+func joinHex(vals []uint16) string {
+	s := make([]string, len(vals))
+	for i, v := range vals {
+		s[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(s, ",")
+}
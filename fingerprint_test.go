@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// ClientHellos in testdata/clienthello were captured from the clients named,
+// connecting to a listener on 127.0.0.1.
+var fingerprintFixtures = []struct {
+	file, ja3String, ja3, ja4 string
+}{
+	{
+		// openssl s_client -servername www.example.com -alpn h2,http/1.1
+		"openssl-3.0-tls13.bin",
+		"771,4866-4867-4865-49196-49200-159-52393-52392-52394-49195-49199-158-49188-49192-107-49187-49191-103-49162-49172-57-49161-49171-51-157-156-61-60-53-47-255,0-11-10-35-16-22-23-13-43-45-51,29-23-30-25-24-256-257-258-259-260,0-1-2",
+		"5a1edc7f170af1014fc65c994878e63c",
+		"t13d3111h2_e8f1e7e78f70_1f22a2ca17c4",
+	},
+	{
+		// curl https://www.example.org/
+		"curl-7.88.bin",
+		"771,4866-4867-4865-49196-49200-159-52393-52392-52394-49195-49199-158-49188-49192-107-49187-49191-103-49162-49172-57-49161-49171-51-157-156-61-60-53-47-255,0-11-10-16-22-23-49-13-43-45-51-21,29-23-30-25-24-256-257-258-259-260,0-1-2",
+		"0149f47eabf9a20d0893e2a44e5a6323",
+		"t13d3112h2_e8f1e7e78f70_b26ce05bbdd6",
+	},
+	{
+		// openssl s_client -tls1_2 -noservername
+		"openssl-3.0-tls12-nosni.bin",
+		"771,49196-49200-159-52393-52392-52394-49195-49199-158-49188-49192-107-49187-49191-103-49162-49172-57-49161-49171-51-157-156-61-60-53-47-255,11-10-35-22-23-13,29-23-30-25-24,0-1-2",
+		"fbe7e189e37a07ee33706f86bc746344",
+		"t12i280600_d943125447b4_e7e480e5a997",
+	},
+}
+
+func readFixture(t *testing.T, name string) *clientHello {
+	b, err := os.ReadFile(filepath.Join("testdata", "clienthello", name))
+	if err != nil {
+		t.Fatalf("could not read fixture: %v", err)
+	}
+	h, err := readClientHello(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("readClientHello() of %s: %v", name, err)
+	}
+	return h
+}
+
+func TestFingerprints(t *testing.T) {
+	for _, f := range fingerprintFixtures {
+		h := readFixture(t, f.file)
+		if got := h.ja3String(); got != f.ja3String {
+			t.Errorf("%s: JA3 string\n%s\nwant\n%s", f.file, got, f.ja3String)
+		}
+		if got := h.ja3(); got != f.ja3 {
+			t.Errorf("%s: JA3 %s, want %s", f.file, got, f.ja3)
+		}
+		if got := h.ja4(); got != f.ja4 {
+			t.Errorf("%s: JA4 %s, want %s", f.file, got, f.ja4)
+		}
+	}
+}
+
+func TestFingerprintsIgnoreGREASE(t *testing.T) {
+	plain := buildClientHello([]uint16{0x1301, 0x1302},
+		ext(extServerName, 0, 6, 0, 0, 3, 'a', '.', 'b'),
+		ext(extALPN, 0, 3, 2, 'h', '2'),
+		ext(extSupportedVersions, 2, 3, 4),
+	)
+	greased := buildClientHello([]uint16{0x0a0a, 0x1301, 0x1302},
+		ext(0x1a1a),
+		ext(extServerName, 0, 6, 0, 0, 3, 'a', '.', 'b'),
+		ext(extALPN, 0, 3, 2, 'h', '2'),
+		ext(extSupportedVersions, 4, 0x2a, 0x2a, 3, 4),
+	)
+	p, err := readClientHello(bytes.NewReader(plain))
+	if err != nil {
+		t.Fatalf("readClientHello(): %v", err)
+	}
+	g, err := readClientHello(bytes.NewReader(greased))
+	if err != nil {
+		t.Fatalf("readClientHello(): %v", err)
+	}
+	if p.ja3() != g.ja3() || p.ja4() != g.ja4() {
+		t.Errorf("GREASE changed the fingerprints: %s %s and %s %s", p.ja3(), p.ja4(), g.ja3(), g.ja4())
+	}
+	if want := "t13d0203h2_"; g.ja4()[:len(want)] != want {
+		t.Errorf("JA4 %s, want it to start %s", g.ja4(), want)
+	}
+}
+
+func TestJA4ALPN(t *testing.T) {
+	tests := []struct {
+		alpn []string
+		want string
+	}{
+		{nil, "00"},
+		{[]string{"http/1.1", "h2"}, "h1"},
+		{[]string{"acme-tls/1"}, "a1"},
+		{[]string{"h2c/"}, "6f"},
+		{[]string{"\xab"}, "ab"},
+	}
+	for _, tt := range tests {
+		if got := ja4ALPN(tt.alpn); got != tt.want {
+			t.Errorf("ja4ALPN(%q) = %s, want %s", tt.alpn, got, tt.want)
+		}
+	}
+}
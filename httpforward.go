@@ -0,0 +1,286 @@
+//
+// httpforward.go - Forwarding plain HTTP requests to the upstream proxy
+//
+// Copyright (C) 2013 Ryan A. Chapman. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+//      this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+//      this list of conditions and the following disclaimer in the documentation
+//      and/or other materials provided with the distribution.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHORS
+// OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+// Connections to the destination ports in -httpports that turn out to speak
+// HTTP/1.x (see sniff.go) aren't tunnelled with CONNECT. Each request the
+// client sends is read and passed to the upstream proxy the way a browser
+// configured to use it would send it, with an absolute URI
+// (GET http://host/path HTTP/1.1), and its response is passed back, whatever
+// its status. Proxy-Authorization and X-Forwarded-For are set on every
+// request, so proxies that only allow or log plain HTTP this way see the same
+// thing for each of them.
+//
+// The client's connection and the one to the upstream proxy are kept open for
+// as long as both sides keep them alive. A request to switch protocols (e.g.
+// to WebSocket) that the upstream accepts turns the connection into a plain
+// relay from then on.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	log "github.com/zdannar/flogger"
+)
+
+// parseHTTPPorts parses a -httpports argument, destination ports separated by
+// commas.
+func parseHTTPPorts(spec string) (map[uint16]bool, error) {
+	ports := make(map[uint16]bool)
+	for _, p := range strings.Split(spec, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(p, 10, 16)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid port %q", p)
+		}
+		ports[uint16(n)] = true
+	}
+	return ports, nil
+}
+
+// handleHTTPForwarding connects to the first upstream proxy that will take
+// a connection, of proxies, and returns a tunnel that forwards the client's
+// requests to it, or nil if none would. p is what was peeked from the client.
+func handleHTTPForwarding(clientConn *net.TCPConn, ipv4 string, port uint16, p *clientPeek, proxies []string) *tunnel {
+	cfg := currentConfig()
+	dst := net.JoinHostPort(ipv4, strconv.Itoa(int(port)))
+	clientIP, _, err := net.SplitHostPort(clientConn.RemoteAddr().String())
+	if err != nil {
+		log.Infof("HTTP|%v->%s|ERR: Could not find the client's address: %v", clientConn.RemoteAddr(), dst, err)
+		clientConn.Close()
+		return nil
+	}
+	for _, proxySpec := range proxies {
+		if state := upstreamState(proxySpec); state != upstreamUp {
+			log.Debugf("HTTP|%v->%v->%s|Proxy is %s, trying next proxy.", clientConn.RemoteAddr(), proxySpec, dst, state)
+			continue
+		}
+		proxyConn, err := dial(proxySpec)
+		if err != nil {
+			log.Debugf("HTTP|%v->%v->%s|Trying next proxy.", clientConn.RemoteAddr(), proxySpec, dst)
+			continue
+		}
+		log.Debugf("HTTP|%v->%v->%s|Connected to proxy", clientConn.RemoteAddr(), proxyConn.RemoteAddr(), dst)
+		incrProxiedConnections()
+		f := &httpForwarder{
+			cfg:      cfg,
+			ipv4:     ipv4,
+			port:     port,
+			auth:     cfg.authProxyServers[proxySpec],
+			clientIP: clientIP,
+			peeked:   p.peeked,
+		}
+		t := trackTunnel(clientConn, proxyConn, dst, proxySpec)
+		t.relay = f.relay
+		return t
+	}
+	log.Infof("HTTP|%v->UNAVAILABLE->%s|ERR: Tried all proxies, but could not establish connection. Giving up.", clientConn.RemoteAddr(), dst)
+	writeHTTPError(clientConn, http.StatusServiceUnavailable, "ERR_NO_PROXIES")
+	clientConn.Close()
+	return nil
+}
+
+// An httpForwarder passes the requests on a tunnel's client connection to its
+// upstream proxy.
+type httpForwarder struct {
+	cfg      *proxyConfig
+	ipv4     string // original destination, named in requests without a Host
+	port     uint16
+	auth     string // base64 encoded credentials for the upstream, or ""
+	clientIP string // for X-Forwarded-For
+	peeked   []byte // read from the client before relay started
+}
+
+// relay forwards requests and responses until one side closes its connection
+// or something goes wrong, and returns how that happened.
+func (f *httpForwarder) relay(t *tunnel) string {
+	clientReader := bufio.NewReader(io.MultiReader(bytes.NewReader(f.peeked), t.client))
+	proxyReader := bufio.NewReader(t.server)
+	for n := 0; ; n++ {
+		req, err := http.ReadRequest(clientReader)
+		if err == io.EOF {
+			return t.endedBy("client", nil)
+		}
+		if err == nil && req.Method == http.MethodConnect {
+			err = errors.New("CONNECT request")
+		}
+		if err != nil {
+			if !t.isClosed() {
+				log.Infof("HTTP|%v|ERR: Could not read request %d from client: %v", t, n+1, err)
+				writeHTTPError(t.client, http.StatusBadRequest, "ERR_BAD_REQUEST")
+			}
+			return t.endedBy("client", err)
+		}
+		if !f.verify(t, req) {
+			writeHTTPError(t.client, http.StatusForbidden, "ERR_DESTINATION_MISMATCH")
+			return t.endedBy("client", fmt.Errorf("request %d refused by -verifyname", n+1))
+		}
+		f.prepare(req)
+		log.Debugf("HTTP|%v|%s %s", t, req.Method, req.URL)
+		if err := req.WriteProxy(t.server); err != nil {
+			incrProxyServerWriteErr()
+			return t.endedBy("proxyserver", err)
+		}
+		incrHTTPRequestsForwarded()
+
+		resp, err := readHTTPResponse(proxyReader, req, t.client)
+		if err != nil {
+			if !t.isClosed() {
+				log.Infof("HTTP|%v|ERR: No response from upstream to %s %s: %v", t, req.Method, req.URL, err)
+				incrHTTPNoResponses()
+				writeHTTPError(t.client, http.StatusBadGateway, "ERR_NO_RESPONSE")
+			}
+			return t.endedBy("proxyserver", err)
+		}
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			if err := resp.Write(t.client); err != nil {
+				return t.endedBy("client", err)
+			}
+			log.Debugf("HTTP|%v|Switched protocols, relaying", t)
+			return relayBuffered(t, clientReader, proxyReader)
+		}
+		// the upstream can only be told to close after the request, so when
+		// the client asked for that, it is passed on here too
+		resp.Close = resp.Close || req.Close
+		if err := resp.Write(t.client); err != nil {
+			return t.endedBy("client", err)
+		}
+		if resp.Close {
+			return "Connection: close"
+		}
+	}
+}
+
+// verify applies -verifyname to the host req is for, pointing req at the
+// destination address instead if the policy says so. It returns false if req
+// is to be refused.
+func (f *httpForwarder) verify(t *tunnel, req *http.Request) bool {
+	hostport := req.Host
+	if req.URL.Host != "" {
+		hostport = req.URL.Host
+	}
+	dst, err := netip.ParseAddr(f.ipv4)
+	if hostport == "" || err != nil {
+		return true
+	}
+	name := hostport
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		name = host
+	}
+	name = strings.Trim(name, "[]")
+	useName, proceed, err := verifyName(f.cfg.verifyPolicy, name, dst)
+	if err != nil {
+		log.Infof("VERIFY|%v|Host name %s %v (-verifyname=%s)", t, name, err, f.cfg.verifyPolicy)
+	}
+	if !useName && proceed {
+		// the upstream replaces Host with the host of the absolute URI anyway
+		req.Host = net.JoinHostPort(f.ipv4, strconv.Itoa(int(f.port)))
+		req.URL.Scheme = "http"
+		req.URL.Host = req.Host
+	}
+	return proceed
+}
+
+// prepare turns req, as the client sent it, into the request for the upstream
+// proxy.
+func (f *httpForwarder) prepare(req *http.Request) {
+	if req.Host == "" {
+		client, _ := netip.ParseAddr(f.clientIP)
+		req.Host = net.JoinHostPort(destinationName(f.cfg, client, f.ipv4), strconv.Itoa(int(f.port)))
+	}
+	if req.URL.Host == "" {
+		req.URL.Scheme = "http"
+		req.URL.Host = req.Host
+	}
+	// only ever our own credentials go upstream
+	req.Header.Del("Proxy-Authorization")
+	req.Header.Del("Proxy-Connection")
+	if f.auth != "" {
+		req.Header.Set("Proxy-Authorization", "Basic "+f.auth)
+	}
+	xff := f.clientIP
+	if prior := req.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+		xff = strings.Join(prior, ", ") + ", " + xff
+	}
+	req.Header.Set("X-Forwarded-For", xff)
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// an empty one keeps net/http from adding its own
+		req.Header["User-Agent"] = []string{""}
+	}
+}
+
+// readHTTPResponse reads the response to req from r, passing any interim 1xx
+// responses other than 101 Switching Protocols on to client as they come.
+func readHTTPResponse(r *bufio.Reader, req *http.Request, client io.Writer) (*http.Response, error) {
+	for {
+		resp, err := http.ReadResponse(r, req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode < 100 || resp.StatusCode >= 200 || resp.StatusCode == http.StatusSwitchingProtocols {
+			return resp, nil
+		}
+		fmt.Fprintf(client, "HTTP/%d.%d %s\r\n", resp.ProtoMajor, resp.ProtoMinor, resp.Status)
+		resp.Header.Write(client)
+		io.WriteString(client, "\r\n")
+	}
+}
+
+// relayBuffered relays t both ways, starting with what has already been read
+// into clientReader and proxyReader, until both directions are done.
+func relayBuffered(t *tunnel, clientReader, proxyReader *bufio.Reader) string {
+	ends := make(chan string, 2)
+	pass := func(dst net.Conn, src io.Reader, srcname string) {
+		_, err := io.Copy(dst, src)
+		if tc, ok := dst.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		}
+		ends <- t.endedBy(srcname, err)
+	}
+	go pass(t.client, proxyReader, "proxyserver")
+	go pass(t.server, clientReader, "client")
+	first := <-ends
+	<-ends
+	return first
+}
+
+// writeHTTPError sends the client a response of our own, for when no upstream
+// response can be passed back.
+func writeHTTPError(w io.Writer, status int, code string) {
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nServer: go-any-proxy\r\nX-AnyProxy-Error: %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", status, http.StatusText(status), code)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseHTTPPorts(t *testing.T) {
+	ports, err := parseHTTPPorts(" 80,8080,")
+	if err != nil || len(ports) != 2 || !ports[80] || !ports[8080] {
+		t.Errorf("parseHTTPPorts() = %v, %v, want 80 and 8080", ports, err)
+	}
+	if ports, err := parseHTTPPorts(""); err != nil || len(ports) != 0 {
+		t.Errorf("parseHTTPPorts(\"\") = %v, %v, want no ports", ports, err)
+	}
+	for _, spec := range []string{"http", "0", "65536", "80;443"} {
+		if _, err := parseHTTPPorts(spec); err == nil {
+			t.Errorf("parseHTTPPorts(%q) did not fail", spec)
+		}
+	}
+}
+
+// fakeHTTPProxy accepts one connection and answers each request on it with
+// the next of responses, sending the requests it got down the channel.
+func fakeHTTPProxy(t *testing.T, responses ...string) (string, chan *http.Request) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	reqs := make(chan *http.Request, len(responses))
+	go func() {
+		defer close(reqs)
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		br := bufio.NewReader(c)
+		for _, resp := range responses {
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				return
+			}
+			body, _ := io.ReadAll(req.Body)
+			req.Body = io.NopCloser(strings.NewReader(string(body)))
+			reqs <- req
+			io.WriteString(c, resp)
+		}
+	}()
+	return l.Addr().String(), reqs
+}
+
+func TestHTTPForwarding(t *testing.T) {
+	upstream, reqs := fakeHTTPProxy(t,
+		"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello",
+		"HTTP/1.1 403 Forbidden\r\nContent-Length: 6\r\n\r\ndenied",
+		"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	cfg, _ := newProxyConfig([]string{upstream}, map[string]string{upstream: "dXNlcjpzZWNyZXQ="}, nil)
+	orig := currentConfig()
+	setConfig(cfg)
+	defer setConfig(orig)
+
+	client, clientSide := tcpPair(t)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(client, "GET /index.html HTTP/1.1\r\nHost: www.example.com\r\nProxy-Authorization: Basic Zm9yZ2Vk\r\nProxy-Connection: keep-alive\r\n\r\n")
+	p := peekClient(clientSide, time.Second, false, false)
+	if p.protocol != protoHTTP {
+		t.Fatalf("peekClient() found %s, want http", p.protocol)
+	}
+	tun := handleHTTPForwarding(clientSide, "192.0.2.10", 80, p, cfg.proxyServers)
+	if tun == nil {
+		t.Fatalf("handleHTTPForwarding() did not set up a tunnel")
+	}
+	done := make(chan bool)
+	go func() {
+		relayTunnel(tun, tun.serverName())
+		close(done)
+	}()
+
+	io.WriteString(client, "POST /form HTTP/1.1\r\nHost: www.example.com:8080\r\nX-Forwarded-For: 10.9.9.9\r\nContent-Length: 4\r\n\r\na=b&")
+	io.WriteString(client, "GET / HTTP/1.0\r\n\r\n")
+
+	want := []struct {
+		method, uri, xff, body string
+	}{
+		{"GET", "http://www.example.com/index.html", "127.0.0.1", ""},
+		{"POST", "http://www.example.com:8080/form", "10.9.9.9, 127.0.0.1", "a=b&"},
+		{"GET", "http://192.0.2.10:80/", "127.0.0.1", ""},
+	}
+	for i, w := range want {
+		req := <-reqs
+		if req == nil {
+			t.Fatalf("upstream did not get request %d", i+1)
+		}
+		body, _ := io.ReadAll(req.Body)
+		if req.Method != w.method || req.RequestURI != w.uri || string(body) != w.body {
+			t.Errorf("request %d = %s %s %q, want %s %s %q", i+1, req.Method, req.RequestURI, body, w.method, w.uri, w.body)
+		}
+		if got := req.Header.Get("Proxy-Authorization"); got != "Basic dXNlcjpzZWNyZXQ=" {
+			t.Errorf("request %d has Proxy-Authorization %q, want ours", i+1, got)
+		}
+		if got := req.Header.Get("X-Forwarded-For"); got != w.xff {
+			t.Errorf("request %d has X-Forwarded-For %q, want %q", i+1, got, w.xff)
+		}
+		if _, ok := req.Header["Proxy-Connection"]; ok {
+			t.Errorf("request %d was sent with Proxy-Connection", i+1)
+		}
+		if _, ok := req.Header["User-Agent"]; ok {
+			t.Errorf("request %d was sent with a User-Agent the client didn't send", i+1)
+		}
+	}
+
+	br := bufio.NewReader(client)
+	for i, w := range []struct {
+		status int
+		body   string
+	}{{200, "hello"}, {403, "denied"}, {200, "ok"}} {
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("no response %d: %v", i+1, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != w.status || string(body) != w.body {
+			t.Errorf("response %d = %d %q, want %d %q", i+1, resp.StatusCode, body, w.status, w.body)
+		}
+	}
+	// the HTTP/1.0 request closes the connection after its response
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("connection still open after the HTTP/1.0 response: %v", err)
+	}
+	<-done
+}
+
+func TestHTTPForwardingNoResponse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		// reads the request and hangs up without answering
+		c, err := l.Accept()
+		if err == nil {
+			http.ReadRequest(bufio.NewReader(c))
+			c.Close()
+		}
+	}()
+	cfg, _ := newProxyConfig([]string{l.Addr().String()}, nil, nil)
+	orig := currentConfig()
+	setConfig(cfg)
+	defer setConfig(orig)
+
+	client, clientSide := tcpPair(t)
+	defer client.Close()
+	tun := handleHTTPForwarding(clientSide, "192.0.2.10", 80, &clientPeek{protocol: protoHTTP}, cfg.proxyServers)
+	if tun == nil {
+		t.Fatalf("handleHTTPForwarding() did not set up a tunnel")
+	}
+	go relayTunnel(tun, tun.serverName())
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(client, "GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("no response: %v", err)
+	}
+	if resp.StatusCode != http.StatusBadGateway || resp.Header.Get("X-AnyProxy-Error") != "ERR_NO_RESPONSE" {
+		t.Errorf("got %s %q, want 502 ERR_NO_RESPONSE", resp.Status, resp.Header.Get("X-AnyProxy-Error"))
+	}
+}
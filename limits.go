@@ -0,0 +1,256 @@
+//
+// limits.go - Caps on concurrent tunnels and on the rate of new connections
+//
+// Copyright (C) 2013 Ryan A. Chapman. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+//      this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+//      this list of conditions and the following disclaimer in the documentation
+//      and/or other materials provided with the distribution.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHORS
+// OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+// Every connection takes a slot in the global, per-client and per-destination
+// counts before anything is done with it, and gives it back when its tunnel
+// ends. Clients are grouped by -clientmask, so a whole subnet can share a
+// limit. New connections from a client group also take a token from that
+// group's bucket, which refills at -clientrate per second up to -clientburst.
+//
+// With -overlimit=queue, a connection over a limit waits up to -queuetimeout
+// for a slot or a token before it is refused.
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	overLimitRefuse = "refuse"
+	overLimitQueue  = "queue"
+)
+
+const defaultQueueTimeout = 5 * time.Second
+
+// IPv6 clients are grouped by /64, the smallest subnet usually handed to one site
+const clientMask6 = 64
+
+// buckets that have been full this long are forgotten
+const bucketIdleExpiry = time.Minute
+
+// reasons a connection is refused, also used to pick the counter
+const (
+	limitTotal  = "too many tunnels"
+	limitClient = "too many tunnels from client"
+	limitDest   = "too many tunnels to destination"
+	limitRate   = "client connection rate exceeded"
+)
+
+type connLimits struct {
+	maxTunnels   int     // -maxtunnels
+	maxPerClient int     // -maxperclient
+	maxPerDest   int     // -maxperdest
+	clientMask   int     // -clientmask, prefix length clients are grouped by
+	clientRate   float64 // -clientrate, new connections per second
+	clientBurst  int     // -clientburst
+	overLimit    string  // -overlimit
+	queueTimeout time.Duration
+}
+
+func (l *connLimits) check() error {
+	if l.maxTunnels < 0 || l.maxPerClient < 0 || l.maxPerDest < 0 || l.clientBurst < 0 || l.clientRate < 0 {
+		return errors.New("limits can not be negative")
+	}
+	if l.clientMask < 0 || l.clientMask > 32 {
+		return fmt.Errorf("-clientmask must be between 0 and 32, not %d", l.clientMask)
+	}
+	if l.overLimit != overLimitRefuse && l.overLimit != overLimitQueue {
+		return fmt.Errorf("-overlimit must be %s or %s, not %q", overLimitRefuse, overLimitQueue, l.overLimit)
+	}
+	return nil
+}
+
+func (l *connLimits) burst() float64 {
+	if l.clientBurst > 0 {
+		return float64(l.clientBurst)
+	}
+	if l.clientRate < 1 {
+		return 1
+	}
+	return l.clientRate
+}
+
+// clientGroup returns the subnet that client's limits are counted against.
+func (l *connLimits) clientGroup(client netip.Addr) netip.Prefix {
+	client = client.Unmap()
+	bits := l.clientMask
+	if client.Is6() {
+		bits = clientMask6
+	}
+	p, err := client.Prefix(bits)
+	if err != nil {
+		return netip.PrefixFrom(client, client.BitLen())
+	}
+	return p
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var gLimits = struct {
+	sync.Mutex
+	total     int
+	perClient map[netip.Prefix]int
+	perDest   map[netip.Addr]int
+	buckets   map[netip.Prefix]*tokenBucket
+	lastSweep time.Time
+	changed   chan bool // closed and replaced whenever a slot is given back
+}{
+	perClient: make(map[netip.Prefix]int),
+	perDest:   make(map[netip.Addr]int),
+	buckets:   make(map[netip.Prefix]*tokenBucket),
+	changed:   make(chan bool),
+}
+
+// admitConnection takes the slots a connection from client to dst needs,
+// waiting for them if the policy is to queue. It returns a function that gives
+// them back, or the reason the connection was refused.
+func admitConnection(l *connLimits, client, dst netip.Addr) (release func(), refused string) {
+	group := l.clientGroup(client)
+	dst = dst.Unmap()
+	queued := false
+	var deadline time.Time
+	if l.overLimit == overLimitQueue {
+		deadline = time.Now().Add(l.queueTimeout)
+	}
+
+	for {
+		gLimits.Lock()
+		now := time.Now()
+		reason, wait := limitsReached(l, group, dst, now)
+		if reason == "" {
+			gLimits.total++
+			gLimits.perClient[group]++
+			gLimits.perDest[dst]++
+			gLimits.Unlock()
+			var once sync.Once
+			return func() { once.Do(func() { releaseConnection(group, dst) }) }, ""
+		}
+		changed := gLimits.changed
+		gLimits.Unlock()
+
+		remaining := deadline.Sub(now)
+		if remaining <= 0 || (reason == limitRate && wait > remaining) {
+			incrLimitRefused(reason)
+			return nil, reason
+		}
+		if !queued {
+			queued = true
+			incrLimitQueued()
+		}
+		if reason != limitRate {
+			wait = remaining
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// limitsReached returns which limit, if any, stops a new connection and, for
+// the rate limit, how long until the next token. If none is reached, it
+// takes a token from the client's bucket. gLimits must be locked.
+func limitsReached(l *connLimits, group netip.Prefix, dst netip.Addr, now time.Time) (string, time.Duration) {
+	switch {
+	case l.maxTunnels > 0 && gLimits.total >= l.maxTunnels:
+		return limitTotal, 0
+	case l.maxPerClient > 0 && gLimits.perClient[group] >= l.maxPerClient:
+		return limitClient, 0
+	case l.maxPerDest > 0 && gLimits.perDest[dst] >= l.maxPerDest:
+		return limitDest, 0
+	}
+	if l.clientRate <= 0 {
+		return "", 0
+	}
+
+	if now.Sub(gLimits.lastSweep) > bucketIdleExpiry {
+		sweepBuckets(l, now)
+	}
+	b := gLimits.buckets[group]
+	if b == nil {
+		b = &tokenBucket{tokens: l.burst(), last: now}
+		gLimits.buckets[group] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.clientRate
+	if b.tokens > l.burst() {
+		b.tokens = l.burst()
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return limitRate, time.Duration((1 - b.tokens) / l.clientRate * float64(time.Second))
+	}
+	b.tokens--
+	return "", 0
+}
+
+// sweepBuckets forgets buckets that would be full by now anyway.
+func sweepBuckets(l *connLimits, now time.Time) {
+	full := time.Duration(l.burst() / l.clientRate * float64(time.Second))
+	for group, b := range gLimits.buckets {
+		if now.Sub(b.last) > full+bucketIdleExpiry {
+			delete(gLimits.buckets, group)
+		}
+	}
+	gLimits.lastSweep = now
+}
+
+func releaseConnection(group netip.Prefix, dst netip.Addr) {
+	gLimits.Lock()
+	gLimits.total--
+	if gLimits.perClient[group]--; gLimits.perClient[group] <= 0 {
+		delete(gLimits.perClient, group)
+	}
+	if gLimits.perDest[dst]--; gLimits.perDest[dst] <= 0 {
+		delete(gLimits.perDest, dst)
+	}
+	close(gLimits.changed)
+	gLimits.changed = make(chan bool)
+	gLimits.Unlock()
+}
+
+func incrLimitRefused(reason string) {
+	switch reason {
+	case limitTotal:
+		incrLimitTotalRefused()
+	case limitClient:
+		incrLimitClientRefused()
+	case limitDest:
+		incrLimitDestRefused()
+	case limitRate:
+		incrLimitRateRefused()
+	}
+}
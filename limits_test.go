@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestLimitsPerClientSubnet(t *testing.T) {
+	l := &connLimits{maxPerClient: 2, clientMask: 24, overLimit: overLimitRefuse}
+	dst := netip.MustParseAddr("192.0.2.1")
+	refusedBefore := numLimitClientRefused()
+
+	r1, refused := admitConnection(l, netip.MustParseAddr("10.9.1.1"), dst)
+	if refused != "" {
+		t.Fatalf("first connection refused: %s", refused)
+	}
+	r2, refused := admitConnection(l, netip.MustParseAddr("10.9.1.2"), dst)
+	if refused != "" {
+		t.Fatalf("second connection refused: %s", refused)
+	}
+	if _, refused := admitConnection(l, netip.MustParseAddr("10.9.1.3"), dst); refused != limitClient {
+		t.Errorf("third connection from the same /24: refused = %q, want %q", refused, limitClient)
+	}
+	r3, refused := admitConnection(l, netip.MustParseAddr("10.9.2.1"), dst)
+	if refused != "" {
+		t.Errorf("connection from another /24 refused: %s", refused)
+	} else {
+		r3()
+	}
+	if n := numLimitClientRefused() - refusedBefore; n != 1 {
+		t.Errorf("counted %d per-client refusals, want 1", n)
+	}
+
+	r1()
+	r1() // releasing twice must not free two slots
+	r4, refused := admitConnection(l, netip.MustParseAddr("10.9.1.3"), dst)
+	if refused != "" {
+		t.Fatalf("connection refused after a slot was released: %s", refused)
+	}
+	if r5, refused := admitConnection(l, netip.MustParseAddr("10.9.1.4"), dst); refused == "" {
+		t.Errorf("double release freed an extra slot")
+		r5()
+	}
+	r4()
+	r2()
+}
+
+func TestLimitsTotalAndDest(t *testing.T) {
+	client := netip.MustParseAddr("10.9.3.1")
+	l := &connLimits{maxTunnels: 1, clientMask: 32, overLimit: overLimitRefuse}
+	release, refused := admitConnection(l, client, netip.MustParseAddr("192.0.2.2"))
+	if refused != "" {
+		t.Fatalf("first connection refused: %s", refused)
+	}
+	if _, refused := admitConnection(l, client, netip.MustParseAddr("192.0.2.3")); refused != limitTotal {
+		t.Errorf("refused = %q, want %q", refused, limitTotal)
+	}
+	release()
+
+	l = &connLimits{maxPerDest: 1, clientMask: 32, overLimit: overLimitRefuse}
+	release, _ = admitConnection(l, client, netip.MustParseAddr("192.0.2.4"))
+	if _, refused := admitConnection(l, netip.MustParseAddr("10.9.3.2"), netip.MustParseAddr("192.0.2.4")); refused != limitDest {
+		t.Errorf("refused = %q, want %q", refused, limitDest)
+	}
+	release()
+}
+
+func TestLimitsQueue(t *testing.T) {
+	client := netip.MustParseAddr("10.9.4.1")
+	dst := netip.MustParseAddr("192.0.2.5")
+	l := &connLimits{maxPerClient: 1, clientMask: 32, overLimit: overLimitQueue, queueTimeout: 5 * time.Second}
+
+	release, _ := admitConnection(l, client, dst)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		release()
+	}()
+	start := time.Now()
+	r2, refused := admitConnection(l, client, dst)
+	if refused != "" {
+		t.Fatalf("queued connection refused: %s", refused)
+	}
+	if waited := time.Since(start); waited < 40*time.Millisecond {
+		t.Errorf("queued connection was admitted after %v, before the first one was released", waited)
+	}
+
+	l.queueTimeout = 50 * time.Millisecond
+	if _, refused := admitConnection(l, client, dst); refused != limitClient {
+		t.Errorf("refused = %q after the queue timeout, want %q", refused, limitClient)
+	}
+	r2()
+}
+
+func TestLimitsClientRate(t *testing.T) {
+	client := netip.MustParseAddr("10.9.5.1")
+	dst := netip.MustParseAddr("192.0.2.6")
+	l := &connLimits{clientMask: 32, clientRate: 20, clientBurst: 2, overLimit: overLimitRefuse}
+
+	for i := 0; i < 2; i++ {
+		release, refused := admitConnection(l, client, dst)
+		if refused != "" {
+			t.Fatalf("connection %d within the burst refused: %s", i, refused)
+		}
+		release()
+	}
+	if _, refused := admitConnection(l, client, dst); refused != limitRate {
+		t.Errorf("refused = %q, want %q", refused, limitRate)
+	}
+
+	// a token comes back every 50ms, which the queue waits for
+	l.overLimit = overLimitQueue
+	l.queueTimeout = time.Second
+	release, refused := admitConnection(l, client, dst)
+	if refused != "" {
+		t.Errorf("queued connection refused: %s", refused)
+	} else {
+		release()
+	}
+}
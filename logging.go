@@ -0,0 +1,500 @@
+//
+// logging.go - Log file reopen/rotation and the syslog and journald log sinks
+//
+// Copyright (C) 2013 Ryan A. Chapman. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+//      this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+//      this list of conditions and the following disclaimer in the documentation
+//      and/or other materials provided with the distribution.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHORS
+// OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+// With -logsink=file (the default), flogger writes straight to the log file,
+// exactly as before. Reopening and rotating just points flogger at a fresh
+// file, so no lines are lost and logrotate no longer needs copytruncate.
+//
+// The syslog and journald sinks need a socket, which flogger can't write to.
+// For those, flogger is pointed at one end of a pipe and a goroutine forwards
+// every line it reads from the other end to the sink.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	log "github.com/zdannar/flogger"
+)
+
+const defaultSyslogAddr = "/dev/log"
+const defaultJournaldAddr = "/run/systemd/journal/socket"
+const logRotationCheckInterval = 10 * time.Second
+const logRotationTimeFormat = "20060102-150405"
+
+// syslog severities (RFC 5424, section 6.2.1), also used for journald's PRIORITY
+const (
+	sevCrit    = 2
+	sevErr     = 3
+	sevWarning = 4
+	sevInfo    = 6
+	sevDebug   = 7
+)
+
+const syslogFacilityDaemon = 3
+
+var gLogRotation *logRotation
+var gLogSinkInUse logSink
+
+// read end of the log pipe and whether the pump is still busy with what it read
+var gLogPipe struct {
+	sync.Mutex
+	r    *os.File
+	busy bool
+}
+
+// logRotation reopens and rotates the log file used by -logsink=file.
+type logRotation struct {
+	path     string
+	maxSize  int64
+	maxAge   time.Duration
+	backups  int
+	compress bool
+
+	mu     sync.Mutex
+	opened time.Time
+}
+
+// reopen points flogger at a freshly opened log file, creating it if it has
+// been moved away.
+func (r *logRotation) reopen() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reopenLocked()
+}
+
+func (r *logRotation) reopenLocked() error {
+	if err := log.OpenFile(r.path, log.FLOG_APPEND, 0644); err != nil {
+		return err
+	}
+	if !r.opened.IsZero() {
+		// stdout/stderr were pointed at the old file by redirectStreams()
+		log.RedirectStreams()
+	}
+	r.opened = time.Now()
+	return nil
+}
+
+// rotate moves the current log file aside, reopens a new one and then
+// compresses and prunes the old ones in the background.
+func (r *logRotation) rotate() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rotated := r.rotatedName(time.Now())
+	if err := os.Rename(r.path, rotated); err != nil {
+		return err
+	}
+	if err := r.reopenLocked(); err != nil {
+		return err
+	}
+	log.Infof("Rotated log file to %s", rotated)
+	go r.cleanup(rotated)
+	return nil
+}
+
+// rotatedName returns a name to move the log file to that no earlier rotation
+// has used, also while its file is still being compressed. Rotations within the
+// same second get a sequence number after the timestamp.
+func (r *logRotation) rotatedName(now time.Time) string {
+	base := r.path + "." + now.Format(logRotationTimeFormat)
+	for seq := 0; ; seq++ {
+		name := base
+		if seq > 0 {
+			name = fmt.Sprintf("%s-%d", base, seq)
+		}
+		if !fileExists(name) && !fileExists(name+".gz") {
+			return name
+		}
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// parseRotatedSuffix parses what rotatedName put after the log file name,
+// without any .gz.
+func parseRotatedSuffix(suffix string) (time.Time, int, bool) {
+	if len(suffix) < len(logRotationTimeFormat) {
+		return time.Time{}, 0, false
+	}
+	t, err := time.Parse(logRotationTimeFormat, suffix[:len(logRotationTimeFormat)])
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	rest := suffix[len(logRotationTimeFormat):]
+	if rest == "" {
+		return t, 0, true
+	}
+	seq, err := strconv.Atoi(strings.TrimPrefix(rest, "-"))
+	if err != nil || !strings.HasPrefix(rest, "-") || seq < 1 {
+		return time.Time{}, 0, false
+	}
+	return t, seq, true
+}
+
+// needsRotation reports whether the log file has outgrown -logmaxsize or -logmaxage.
+func (r *logRotation) needsRotation() bool {
+	r.mu.Lock()
+	opened := r.opened
+	r.mu.Unlock()
+	if r.maxAge > 0 && time.Since(opened) >= r.maxAge {
+		return true
+	}
+	if r.maxSize > 0 {
+		fi, err := os.Stat(r.path)
+		if err == nil && fi.Size() >= r.maxSize {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *logRotation) watch(interval time.Duration) {
+	for _ = range time.Tick(interval) {
+		if !r.needsRotation() {
+			continue
+		}
+		if err := r.rotate(); err != nil {
+			log.Infof("ERR: Could not rotate log file %s: %v", r.path, err)
+		}
+	}
+}
+
+func (r *logRotation) cleanup(rotated string) {
+	if r.compress {
+		if err := gzipFile(rotated); err != nil {
+			log.Infof("ERR: Could not compress rotated log file %s: %v", rotated, err)
+		}
+	}
+	if r.backups > 0 {
+		r.prune()
+	}
+}
+
+// prune removes the oldest rotated log files, keeping the newest -logbackups of them.
+func (r *logRotation) prune() {
+	matches, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return
+	}
+	type rotatedFile struct {
+		name string
+		t    time.Time
+		seq  int
+	}
+	var old []rotatedFile
+	for _, m := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(m, r.path+"."), ".gz")
+		if t, seq, ok := parseRotatedSuffix(suffix); ok {
+			old = append(old, rotatedFile{m, t, seq})
+		}
+	}
+	sort.Slice(old, func(i, j int) bool {
+		if !old[i].t.Equal(old[j].t) {
+			return old[i].t.Before(old[j].t)
+		}
+		return old[i].seq < old[j].seq
+	})
+	for len(old) > r.backups {
+		if err := os.Remove(old[0].name); err != nil {
+			log.Infof("ERR: Could not remove old log file %s: %v", old[0].name, err)
+		}
+		old = old[1:]
+	}
+}
+
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err = io.Copy(zw, in); err == nil {
+		err = zw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// logSink receives one log line at a time from the log pipe.
+type logSink interface {
+	writeLine(line []byte) error
+	reopen() error
+}
+
+// startLogPipe points flogger at a pipe and forwards everything written to it to sink.
+func startLogPipe(sink logSink) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	// flogger only takes a path, so give it the write end through /proc
+	err = log.OpenFile(fmt.Sprintf("/proc/self/fd/%d", w.Fd()), log.FLOG_APPEND, 0644)
+	w.Close()
+	if err != nil {
+		r.Close()
+		return err
+	}
+	gLogSinkInUse = sink
+	gLogPipe.r = r
+	go pumpLog(r, sink)
+	return nil
+}
+
+func pumpLog(r io.Reader, sink logSink) {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		setLogPipeBusy(true)
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) > 0 {
+			if werr := sink.writeLine(line); werr != nil {
+				// the daemon on the other end may have restarted, try once more
+				if sink.reopen() == nil {
+					sink.writeLine(line)
+				}
+			}
+		}
+		setLogPipeBusy(br.Buffered() > 0)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func setLogPipeBusy(busy bool) {
+	gLogPipe.Lock()
+	gLogPipe.busy = busy
+	gLogPipe.Unlock()
+}
+
+// flushLogs waits, for at most timeout, until everything written to the log
+// pipe has been handed to the sink. Without it, the last lines logged before
+// exiting would die in the pipe.
+func flushLogs(timeout time.Duration) {
+	if gLogPipe.r == nil {
+		return
+	}
+	idle := 0
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		gLogPipe.Lock()
+		busy := gLogPipe.busy
+		gLogPipe.Unlock()
+		if busy || logPipeUnread() > 0 {
+			idle = 0
+			continue
+		}
+		// the pump may have just read the last line and not yet written it,
+		// so only trust two idle looks in a row
+		if idle++; idle == 2 {
+			return
+		}
+	}
+}
+
+// logPipeUnread returns the number of bytes waiting in the log pipe.
+func logPipeUnread() int {
+	rc, err := gLogPipe.r.SyscallConn()
+	if err != nil {
+		return 0
+	}
+	var n int32
+	rc.Control(func(fd uintptr) {
+		syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCINQ, uintptr(unsafe.Pointer(&n)))
+	})
+	return int(n)
+}
+
+// logSeverity guesses the syslog severity of a line formatted by flogger.
+func logSeverity(line []byte) int {
+	switch {
+	case bytes.Contains(line, []byte("DEBUG")):
+		return sevDebug
+	case bytes.Contains(line, []byte("FATAL")), bytes.Contains(line, []byte("CRIT")):
+		return sevCrit
+	case bytes.Contains(line, []byte("ERR")):
+		return sevErr
+	case bytes.Contains(line, []byte("WARN")):
+		return sevWarning
+	}
+	return sevInfo
+}
+
+// datagramSink is a unix datagram socket that is redialed on reopen.
+type datagramSink struct {
+	addr string
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (s *datagramSink) reopen() error {
+	conn, err := net.Dial("unixgram", s.addr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.conn = conn
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *datagramSink) send(msg []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.conn.Write(msg)
+	return err
+}
+
+// syslogSink sends RFC 5424 formatted messages to the local syslog daemon.
+type syslogSink struct {
+	datagramSink
+	hostname string
+	pid      int
+}
+
+func newSyslogSink(addr string) (*syslogSink, error) {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	s := &syslogSink{datagramSink: datagramSink{addr: addr}, hostname: hostname, pid: os.Getpid()}
+	if err := s.reopen(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *syslogSink) format(line []byte, now time.Time) []byte {
+	pri := syslogFacilityDaemon*8 + logSeverity(line)
+	// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+	hdr := fmt.Sprintf("<%d>1 %s %s any_proxy %d - - ", pri, now.Format("2006-01-02T15:04:05.000000Z07:00"), s.hostname, s.pid)
+	return append([]byte(hdr), line...)
+}
+
+func (s *syslogSink) writeLine(line []byte) error {
+	return s.send(s.format(line, time.Now()))
+}
+
+// journaldSink speaks journald's native protocol, see
+// https://systemd.io/JOURNAL_NATIVE_PROTOCOL/
+type journaldSink struct {
+	datagramSink
+	pid int
+}
+
+func newJournaldSink(addr string) (*journaldSink, error) {
+	s := &journaldSink{datagramSink: datagramSink{addr: addr}, pid: os.Getpid()}
+	if err := s.reopen(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *journaldSink) format(line []byte) []byte {
+	var b bytes.Buffer
+	journaldField(&b, "MESSAGE", line)
+	journaldField(&b, "PRIORITY", []byte(fmt.Sprint(logSeverity(line))))
+	journaldField(&b, "SYSLOG_IDENTIFIER", []byte("any_proxy"))
+	journaldField(&b, "SYSLOG_PID", []byte(fmt.Sprint(s.pid)))
+	return b.Bytes()
+}
+
+func (s *journaldSink) writeLine(line []byte) error {
+	return s.send(s.format(line))
+}
+
+// journaldField appends one KEY=value field. Values containing a newline use
+// the binary form: KEY\n, a little endian 64 bit length, the value and \n.
+func journaldField(b *bytes.Buffer, key string, value []byte) {
+	b.WriteString(key)
+	if bytes.IndexByte(value, '\n') < 0 {
+		b.WriteByte('=')
+		b.Write(value)
+		b.WriteByte('\n')
+		return
+	}
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.Write(value)
+	b.WriteByte('\n')
+}
+
+// redirectStreams sends stdout and stderr to the log file. With the socket
+// sinks they are left alone, so that a panic still reaches whatever started
+// us instead of dying in the log pipe together with the process.
+func redirectStreams() {
+	if gLogRotation != nil {
+		log.RedirectStreams()
+	}
+}
+
+// reopenLogs reopens the log file, or reconnects to the syslog/journald socket.
+func reopenLogs() error {
+	var err error
+	if gLogRotation != nil {
+		err = gLogRotation.reopen()
+	} else if gLogSinkInUse != nil {
+		err = gLogSinkInUse.reopen()
+	}
+	if err != nil {
+		log.Infof("ERR: Could not reopen log output: %v", err)
+		return err
+	}
+	log.Infof("Reopened log output")
+	return nil
+}
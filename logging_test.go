@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listen on a unix datagram socket standing in for /dev/log or journald
+func listenStandIn(t *testing.T, name string) (*net.UnixConn, string) {
+	addr := filepath.Join(t.TempDir(), name)
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("could not listen on %s: %v", addr, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, addr
+}
+
+func readDatagram(t *testing.T, conn *net.UnixConn) []byte {
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("did not receive a datagram: %v", err)
+	}
+	return buf[:n]
+}
+
+func TestSyslogSink(t *testing.T) {
+	conn, addr := listenStandIn(t, "log")
+	sink, err := newSyslogSink(addr)
+	if err != nil {
+		t.Fatalf("newSyslogSink(%s) failed: %v", addr, err)
+	}
+	sink.hostname = "gw1"
+	sink.pid = 42
+
+	now := time.Date(2020, 9, 4, 10, 11, 12, 345678000, time.UTC)
+	got := string(sink.format([]byte("DEBUG: lookup(): CACHE_HIT"), now))
+	want := "<31>1 2020-09-04T10:11:12.345678Z gw1 any_proxy 42 - - DEBUG: lookup(): CACHE_HIT"
+	if got != want {
+		t.Errorf("format() = %q, want %q", got, want)
+	}
+
+	if err := sink.writeLine([]byte("INFO: Listening for connections on [::]:3128")); err != nil {
+		t.Fatalf("writeLine() failed: %v", err)
+	}
+	msg := string(readDatagram(t, conn))
+	if !strings.HasPrefix(msg, "<30>1 ") || !strings.HasSuffix(msg, " any_proxy 42 - - INFO: Listening for connections on [::]:3128") {
+		t.Errorf("syslog socket received %q", msg)
+	}
+}
+
+func TestJournaldSink(t *testing.T) {
+	conn, addr := listenStandIn(t, "socket")
+	sink, err := newJournaldSink(addr)
+	if err != nil {
+		t.Fatalf("newJournaldSink(%s) failed: %v", addr, err)
+	}
+	sink.pid = 42
+
+	if err := sink.writeLine([]byte("INFO: ERR: Could not open stats file")); err != nil {
+		t.Fatalf("writeLine() failed: %v", err)
+	}
+	got := string(readDatagram(t, conn))
+	want := "MESSAGE=INFO: ERR: Could not open stats file\nPRIORITY=3\nSYSLOG_IDENTIFIER=any_proxy\nSYSLOG_PID=42\n"
+	if got != want {
+		t.Errorf("journald socket received %q, want %q", got, want)
+	}
+
+	// multi-line values must use the binary length-prefixed form
+	var b bytes.Buffer
+	journaldField(&b, "MESSAGE", []byte("a\nb"))
+	var wantb bytes.Buffer
+	wantb.WriteString("MESSAGE\n")
+	binary.Write(&wantb, binary.LittleEndian, uint64(3))
+	wantb.WriteString("a\nb\n")
+	if !bytes.Equal(b.Bytes(), wantb.Bytes()) {
+		t.Errorf("journaldField() = %q, want %q", b.Bytes(), wantb.Bytes())
+	}
+}
+
+func TestLogRotationPrune(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "any_proxy.log")
+	r := &logRotation{path: path, backups: 2, compress: true}
+
+	names := []string{"20200101-000000", "20200102-000000", "20200103-000000"}
+	for _, n := range names {
+		os.WriteFile(path+"."+n, []byte("old log lines\n"), 0644)
+	}
+	os.WriteFile(path+".keepme", nil, 0644)
+
+	r.cleanup(path + "." + names[2])
+
+	if _, err := os.Stat(path + "." + names[0]); !os.IsNotExist(err) {
+		t.Errorf("oldest rotated log %s should have been removed", names[0])
+	}
+	if _, err := os.Stat(path + "." + names[1]); err != nil {
+		t.Errorf("rotated log %s should have been kept: %v", names[1], err)
+	}
+	if _, err := os.Stat(path + "." + names[2] + ".gz"); err != nil {
+		t.Errorf("rotated log %s should have been compressed: %v", names[2], err)
+	}
+	if _, err := os.Stat(path + ".keepme"); err != nil {
+		t.Errorf("files not created by rotation should be left alone: %v", err)
+	}
+}
+
+func TestLogRotationSameSecond(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "any_proxy.log")
+	r := &logRotation{path: path, backups: 2}
+	now := time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC)
+
+	first := r.rotatedName(now)
+	if first != path+".20200103-000000" {
+		t.Errorf("first rotation goes to %s", first)
+	}
+	os.WriteFile(first+".gz", nil, 0644) // compressed already
+	second := r.rotatedName(now)
+	os.WriteFile(second, nil, 0644)
+	third := r.rotatedName(now)
+	os.WriteFile(third, nil, 0644)
+	if second != first+"-1" || third != first+"-2" {
+		t.Errorf("rotations in the same second go to %s and %s, want %s-1 and %s-2", second, third, first, first)
+	}
+	for i := 3; i <= 10; i++ {
+		os.WriteFile(r.rotatedName(now), nil, 0644)
+	}
+
+	// the sequence numbers order rotations within the second
+	r.prune()
+	for _, kept := range []string{first + "-9", first + "-10"} {
+		if _, err := os.Stat(kept); err != nil {
+			t.Errorf("newest rotated log %s should have been kept: %v", kept, err)
+		}
+	}
+	if matches, _ := filepath.Glob(path + ".*"); len(matches) != 2 {
+		t.Errorf("pruning left %v, want 2 files", matches)
+	}
+}
+
+func TestLogRotationNeedsRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "any_proxy.log")
+	os.WriteFile(path, make([]byte, 2048), 0644)
+
+	r := &logRotation{path: path, maxSize: 1024, opened: time.Now()}
+	if !r.needsRotation() {
+		t.Errorf("a 2048 byte log should be rotated with maxSize=1024")
+	}
+	r = &logRotation{path: path, maxSize: 4096, opened: time.Now()}
+	if r.needsRotation() {
+		t.Errorf("a 2048 byte log should not be rotated with maxSize=4096")
+	}
+	r = &logRotation{path: path, maxAge: time.Hour, opened: time.Now().Add(-2 * time.Hour)}
+	if !r.needsRotation() {
+		t.Errorf("a log opened 2h ago should be rotated with maxAge=1h")
+	}
+}
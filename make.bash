@@ -28,7 +28,7 @@ function pull_deps()
 function build ()
 {
     make_version
-    go build any_proxy.go sni.go stats.go version.go
+    CGO_ENABLED=0 go build any_proxy.go accept.go admin.go config.go credentials.go dns.go fingerprint.go httpforward.go limits.go logging.go origdst.go privileges.go relay.go relay_epoll.go reload.go reverse.go rules.go shutdown.go sni.go sniff.go state.go stats.go systemd.go tunnels.go upgrade.go verify.go version.go
     return $?
 }
 
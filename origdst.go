@@ -0,0 +1,155 @@
+//
+// origdst.go - Finding out where a redirected connection was headed
+//
+// Copyright (C) 2013 Ryan A. Chapman. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+//      this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+//      this list of conditions and the following disclaimer in the documentation
+//      and/or other materials provided with the distribution.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHORS
+// OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+// An iptables REDIRECT or DNAT rule rewrites the destination of a connection
+// to point at any_proxy, and conntrack remembers the original one, which
+// SO_ORIGINAL_DST (IP6T_SO_ORIGINAL_DST for ip6tables) reads back. A TPROXY
+// rule leaves the destination alone, so on a transparent socket (e.g. from a
+// systemd socket unit with Transparent=yes) it is just the local address.
+// Either way the lookup is done on the accepted socket in place.
+//
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"syscall"
+	"unsafe"
+
+	log "github.com/zdannar/flogger"
+)
+
+const (
+	SO_ORIGINAL_DST      = 80
+	IP6T_SO_ORIGINAL_DST = 80
+	IP_TRANSPARENT       = 19
+	IPV6_TRANSPARENT     = 75
+)
+
+// origDstLookup finds the original destination of the connection on fd.
+type origDstLookup func(fd int) (netip.AddrPort, error)
+
+// getOriginalDst returns where clientConn was headed before it was
+// redirected to any_proxy.
+func getOriginalDst(clientConn *net.TCPConn) (netip.AddrPort, error) {
+	if clientConn == nil {
+		log.Debugf("getOriginalDst(): oops, clientConn is nil!")
+		return netip.AddrPort{}, errors.New("ERR: clientConn is nil")
+	}
+
+	// test if the underlying fd is nil
+	remoteAddr := clientConn.RemoteAddr()
+	if remoteAddr == nil {
+		log.Debugf("getOriginalDst(): oops, clientConn.fd is nil!")
+		return netip.AddrPort{}, errors.New("ERR: clientConn.fd is nil")
+	}
+
+	local := clientConn.LocalAddr().(*net.TCPAddr).AddrPort().Addr()
+	var dst netip.AddrPort
+	var lerr error
+	rc, err := clientConn.SyscallConn()
+	if err == nil {
+		err = rc.Control(func(fd uintptr) {
+			dst, lerr = origDstLookupFor(int(fd), local)(int(fd))
+		})
+	}
+	if err == nil {
+		err = lerr
+	}
+	if err != nil {
+		incrGetOriginalDstErrors()
+		log.Infof("GETORIGINALDST|%v->?->FAILEDTOBEDETERMINED|ERR: %v", remoteAddr, err)
+		return netip.AddrPort{}, err
+	}
+	log.Debugf("getOriginalDst(): %v->%v", remoteAddr, dst)
+	return dst, nil
+}
+
+// origDstLookupFor picks the lookup for the connection on fd, which was
+// accepted on the local address local.
+func origDstLookupFor(fd int, local netip.Addr) origDstLookup {
+	// an IPv4 client of a dual-stack socket is still tracked as IPv4
+	level, opt := syscall.SOL_IP, IP_TRANSPARENT
+	if !local.Is4() {
+		level, opt = syscall.SOL_IPV6, IPV6_TRANSPARENT
+	}
+	if v, err := syscall.GetsockoptInt(fd, level, opt); err == nil && v != 0 {
+		return origDstTransparent
+	}
+	if local.Unmap().Is4() {
+		return origDstIPv4
+	}
+	return origDstIPv6
+}
+
+func origDstIPv4(fd int) (netip.AddrPort, error) {
+	var sa syscall.RawSockaddrInet4
+	if err := getsockoptSockaddr(fd, syscall.SOL_IP, SO_ORIGINAL_DST, unsafe.Pointer(&sa), unsafe.Sizeof(sa)); err != nil {
+		return netip.AddrPort{}, os.NewSyscallError("getsockopt(SO_ORIGINAL_DST)", err)
+	}
+	return netip.AddrPortFrom(netip.AddrFrom4(sa.Addr), ntohs(sa.Port)), nil
+}
+
+func origDstIPv6(fd int) (netip.AddrPort, error) {
+	var sa syscall.RawSockaddrInet6
+	if err := getsockoptSockaddr(fd, syscall.SOL_IPV6, IP6T_SO_ORIGINAL_DST, unsafe.Pointer(&sa), unsafe.Sizeof(sa)); err != nil {
+		return netip.AddrPort{}, os.NewSyscallError("getsockopt(IP6T_SO_ORIGINAL_DST)", err)
+	}
+	return netip.AddrPortFrom(netip.AddrFrom16(sa.Addr).Unmap(), ntohs(sa.Port)), nil
+}
+
+func origDstTransparent(fd int) (netip.AddrPort, error) {
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		return netip.AddrPort{}, os.NewSyscallError("getsockname", err)
+	}
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return netip.AddrPortFrom(netip.AddrFrom4(sa.Addr), uint16(sa.Port)), nil
+	case *syscall.SockaddrInet6:
+		return netip.AddrPortFrom(netip.AddrFrom16(sa.Addr).Unmap(), uint16(sa.Port)), nil
+	}
+	return netip.AddrPort{}, errors.New("transparent socket is not IPv4 or IPv6")
+}
+
+func getsockoptSockaddr(fd, level, opt int, sa unsafe.Pointer, size uintptr) error {
+	n := uint32(size)
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(opt),
+		uintptr(sa), uintptr(unsafe.Pointer(&n)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// ntohs converts a port as stored in a raw sockaddr.
+func ntohs(port uint16) uint16 {
+	b := (*[2]byte)(unsafe.Pointer(&port))
+	return uint16(b[0])<<8 | uint16(b[1])
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func sameLookup(a, b origDstLookup) bool {
+	return reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer()
+}
+
+func lookupFor(t *testing.T, c *net.TCPConn) origDstLookup {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn(): %v", err)
+	}
+	local := c.LocalAddr().(*net.TCPAddr).AddrPort().Addr()
+	var lookup origDstLookup
+	rc.Control(func(fd uintptr) {
+		lookup = origDstLookupFor(int(fd), local)
+	})
+	return lookup
+}
+
+func TestOrigDstLookupFor(t *testing.T) {
+	_, c4 := tcpPair(t)
+	defer c4.Close()
+	if lookup := lookupFor(t, c4); !sameLookup(lookup, origDstIPv4) {
+		t.Errorf("IPv4 connection does not use SO_ORIGINAL_DST")
+	}
+
+	l, err := net.ListenTCP("tcp6", &net.TCPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("no IPv6: %v", err)
+	}
+	defer l.Close()
+	c, err := net.DialTCP("tcp6", nil, l.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer c.Close()
+	c6, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatalf("could not accept: %v", err)
+	}
+	defer c6.Close()
+	if lookup := lookupFor(t, c6); !sameLookup(lookup, origDstIPv6) {
+		t.Errorf("IPv6 connection does not use IP6T_SO_ORIGINAL_DST")
+	}
+}
+
+// Without a redirect there is no original destination to find.
+func TestGetOriginalDstNotRedirected(t *testing.T) {
+	client, c := tcpPair(t)
+	defer client.Close()
+	defer c.Close()
+	before := numGetOriginalDstErrors()
+	if dst, err := getOriginalDst(c); err == nil {
+		t.Errorf("getOriginalDst() = %v for a connection that was not redirected", dst)
+	}
+	if n := numGetOriginalDstErrors() - before; n != 1 {
+		t.Errorf("counted %d errors, want 1", n)
+	}
+	if _, err := c.Write([]byte("x")); err != nil {
+		t.Errorf("connection unusable after the lookup: %v", err)
+	}
+}
+
+func TestGetOriginalDstTransparent(t *testing.T) {
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer l.Close()
+	rc, _ := l.SyscallConn()
+	var serr error
+	rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, IP_TRANSPARENT, 1)
+	})
+	if serr != nil {
+		t.Skipf("can't make a transparent socket: %v", serr)
+	}
+	client, err := net.DialTCP("tcp4", nil, l.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer client.Close()
+	c, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatalf("could not accept: %v", err)
+	}
+	defer c.Close()
+
+	dst, err := getOriginalDst(c)
+	want := l.Addr().(*net.TCPAddr).AddrPort()
+	if err != nil || dst != want {
+		t.Errorf("getOriginalDst() = %v, %v, want %v", dst, err, want)
+	}
+}
+
+func TestNtohs(t *testing.T) {
+	var sa syscall.RawSockaddrInet4
+	b := (*[2]byte)(unsafe.Pointer(&sa.Port))
+	b[0], b[1] = 0x1f, 0x90
+	if got := ntohs(sa.Port); got != 8080 {
+		t.Errorf("ntohs() = %d, want 8080", got)
+	}
+}
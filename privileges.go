@@ -0,0 +1,224 @@
+//
+// privileges.go - Switching to an unprivileged user once the listeners are bound
+//
+// Copyright (C) 2013 Ryan A. Chapman. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+//      this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+//      this list of conditions and the following disclaimer in the documentation
+//      and/or other materials provided with the distribution.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHORS
+// OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+// With -user and -group, any_proxy binds its sockets as whoever started it and
+// then switches to the given uid and gid, dropping supplementary groups and
+// every capability except those in -keepcaps. Those are kept through the
+// switch with PR_SET_KEEPCAPS and also raised as ambient capabilities, so that
+// the process started by an upgrade (SIGUSR2) has them too.
+//
+// Capabilities are per thread, so they are changed on all of the process's
+// threads with syscall.AllThreadsSyscall, which isn't available in binaries
+// built with cgo, so -keepcaps needs one built with CGO_ENABLED=0, as make.bash
+// does.
+//
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	log "github.com/zdannar/flogger"
+)
+
+const (
+	PR_SET_KEEPCAPS            = 8
+	PR_CAP_AMBIENT             = 47
+	PR_CAP_AMBIENT_RAISE       = 2
+	LINUX_CAPABILITY_VERSION_3 = 0x20080522
+)
+
+// The capabilities -keepcaps knows, the ones any_proxy may have a use for.
+var capNumbers = map[string]uint{
+	"net_bind_service": 10,
+	"net_admin":        12,
+	"net_raw":          13,
+	"sys_resource":     24,
+}
+
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective   uint32
+	permitted   uint32
+	inheritable uint32
+}
+
+// parseCaps turns a -keepcaps list, e.g. "net_admin,CAP_NET_RAW", into a
+// capability mask.
+func parseCaps(list string) (uint64, error) {
+	var mask uint64
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(name)), "cap_")
+		if name == "" {
+			continue
+		}
+		n, ok := capNumbers[name]
+		if !ok {
+			var known []string
+			for k := range capNumbers {
+				known = append(known, k)
+			}
+			sort.Strings(known)
+			return 0, fmt.Errorf("unknown capability %q, must be one of %s", name, strings.Join(known, ", "))
+		}
+		mask |= 1 << n
+	}
+	return mask, nil
+}
+
+// lookupIDs resolves -user and -group, either of which can be a name or a
+// number. Without -group, the user's primary group is used.
+func lookupIDs(userName, groupName string) (uid, gid int, err error) {
+	uid, gid = os.Getuid(), os.Getgid()
+	if userName != "" {
+		if n, err := strconv.Atoi(userName); err == nil {
+			uid = n
+		} else {
+			u, err := user.Lookup(userName)
+			if err != nil {
+				return 0, 0, err
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+			gid, _ = strconv.Atoi(u.Gid)
+		}
+	}
+	if groupName != "" {
+		if n, err := strconv.Atoi(groupName); err == nil {
+			gid = n
+		} else {
+			g, err := user.LookupGroup(groupName)
+			if err != nil {
+				return 0, 0, err
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+	return uid, gid, nil
+}
+
+// setupPrivileges drops privileges as -user, -group and -keepcaps say, and
+// exits if that fails, rather than carry on with more than was asked for.
+func setupPrivileges() {
+	if gUser == "" && gGroup == "" {
+		return
+	}
+	keep, err := parseCaps(gKeepCaps)
+	if err == nil {
+		var uid, gid int
+		uid, gid, err = lookupIDs(gUser, gGroup)
+		if err == nil {
+			err = dropPrivileges(uid, gid, keep)
+		}
+	}
+	if err != nil {
+		log.Fatalf("Could not drop privileges, not starting: %v", err)
+	}
+	log.Infof("Running as uid %d, gid %d with capabilities %#x", os.Getuid(), os.Getgid(), keep)
+}
+
+// dropPrivileges switches every thread to uid and gid, keeping only the
+// capabilities in keep.
+func dropPrivileges(uid, gid int, keep uint64) error {
+	already := os.Getuid() == uid && os.Geteuid() == uid && os.Getgid() == gid && os.Getegid() == gid
+	if !already {
+		if keep != 0 {
+			if err := allThreadsPrctl(PR_SET_KEEPCAPS, 1, 0); err != nil {
+				return err
+			}
+		}
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return os.NewSyscallError("setgroups", err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return os.NewSyscallError("setgid", err)
+		}
+		if err := syscall.Setuid(uid); err != nil {
+			return os.NewSyscallError("setuid", err)
+		}
+	}
+	// Switching away from root clears every capability unless PR_SET_KEEPCAPS
+	// is set, so they only need setting when some are kept. That is also the
+	// case when the process we were upgraded from switched already, leaving
+	// us the ambient capabilities.
+	if keep != 0 {
+		if err := setCaps(keep); err != nil {
+			return err
+		}
+	}
+	if uid != 0 && syscall.Setuid(0) == nil {
+		return fmt.Errorf("could switch back to root after switching to uid %d", uid)
+	}
+	return nil
+}
+
+// setCaps makes keep the effective, permitted and inheritable capabilities of
+// every thread, and raises them as ambient capabilities.
+func setCaps(keep uint64) error {
+	hdr := &capHeader{version: LINUX_CAPABILITY_VERSION_3}
+	data := &[2]capData{}
+	data[0] = capData{effective: uint32(keep), permitted: uint32(keep), inheritable: uint32(keep)}
+	data[1] = capData{effective: uint32(keep >> 32), permitted: uint32(keep >> 32), inheritable: uint32(keep >> 32)}
+	_, _, errno := syscall.AllThreadsSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(hdr)), uintptr(unsafe.Pointer(data)), 0)
+	runtime.KeepAlive(hdr)
+	runtime.KeepAlive(data)
+	if errno == syscall.ENOTSUP {
+		return fmt.Errorf("can't change capabilities in a binary built with cgo, build with CGO_ENABLED=0")
+	}
+	if errno != 0 {
+		return os.NewSyscallError("capset", errno)
+	}
+	for c := uint(0); c < 64; c++ {
+		if keep&(1<<c) != 0 {
+			if err := allThreadsPrctl(PR_CAP_AMBIENT, PR_CAP_AMBIENT_RAISE, uintptr(c)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func allThreadsPrctl(option, arg2, arg3 uintptr) error {
+	_, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, option, arg2, arg3)
+	if errno == syscall.ENOTSUP {
+		return fmt.Errorf("can't keep capabilities in a binary built with cgo, build with CGO_ENABLED=0")
+	}
+	if errno != 0 {
+		return os.NewSyscallError("prctl", errno)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestParseCaps(t *testing.T) {
+	tests := []struct {
+		in   string
+		want uint64
+	}{
+		{"", 0},
+		{"net_admin", 1 << 12},
+		{"CAP_NET_ADMIN, net_raw", 1<<12 | 1<<13},
+		{"net_bind_service,", 1 << 10},
+	}
+	for _, tt := range tests {
+		got, err := parseCaps(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("parseCaps(%q) = %#x, %v, want %#x", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"sys_admin", "setuid", "net_admin,bogus"} {
+		if _, err := parseCaps(in); err == nil {
+			t.Errorf("parseCaps(%q) did not fail", in)
+		}
+	}
+}
+
+func TestLookupIDs(t *testing.T) {
+	uid, gid, err := lookupIDs("65534", "65533")
+	if err != nil || uid != 65534 || gid != 65533 {
+		t.Errorf("lookupIDs(65534, 65533) = %d, %d, %v", uid, gid, err)
+	}
+	uid, gid, err = lookupIDs("", "")
+	if err != nil || uid != os.Getuid() || gid != os.Getgid() {
+		t.Errorf("lookupIDs() = %d, %d, %v, want the current ids", uid, gid, err)
+	}
+	if _, _, err := lookupIDs("no-such-user-any-proxy", ""); err == nil {
+		t.Errorf("lookupIDs() of an unknown user did not fail")
+	}
+	if _, _, err := lookupIDs("", "no-such-group-any-proxy"); err == nil {
+		t.Errorf("lookupIDs() of an unknown group did not fail")
+	}
+}
+
+// threadStatus returns the value of field in /proc/self/task/*/status for
+// every thread of the process.
+func threadStatus(t *testing.T, field string) []string {
+	paths, err := filepath.Glob("/proc/self/task/*/status")
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("no thread status files: %v", err)
+	}
+	var vals []string
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			// the thread exited
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if v, ok := strings.CutPrefix(line, field+":"); ok {
+				vals = append(vals, strings.TrimSpace(v))
+			}
+		}
+	}
+	return vals
+}
+
+// TestDropPrivileges runs itself in a child process, since privileges can't
+// be got back once dropped.
+func TestDropPrivileges(t *testing.T) {
+	if os.Getenv("ANY_PROXY_TEST_DROP") == "1" {
+		dropPrivilegesChild(t)
+		return
+	}
+	if os.Getuid() != 0 {
+		t.Skip("not running as root")
+	}
+	for _, keep := range []string{"", "net_admin"} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestDropPrivileges$", "-test.v")
+		cmd.Env = append(os.Environ(), "ANY_PROXY_TEST_DROP=1", "ANY_PROXY_TEST_KEEP="+keep)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Errorf("keeping %q: %v\n%s", keep, err, out)
+		} else if strings.Contains(string(out), "--- SKIP") {
+			t.Logf("keeping %q: %s", keep, out)
+		}
+	}
+}
+
+func dropPrivilegesChild(t *testing.T) {
+	keep, err := parseCaps(os.Getenv("ANY_PROXY_TEST_KEEP"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, errno := syscall.AllThreadsSyscall(syscall.SYS_GETPID, 0, 0, 0)
+	if keep != 0 && errno == syscall.ENOTSUP {
+		t.Skip("built with cgo, capabilities can't be changed")
+	}
+	if err := dropPrivileges(65534, 65534, keep); err != nil {
+		t.Fatalf("dropPrivileges(): %v", err)
+	}
+	for _, uids := range threadStatus(t, "Uid") {
+		if uids != "65534\t65534\t65534\t65534" {
+			t.Errorf("thread has uids %q, want 65534", uids)
+		}
+	}
+	for _, gids := range threadStatus(t, "Groups") {
+		if gids != "65534" {
+			t.Errorf("thread has supplementary groups %q, want 65534", gids)
+		}
+	}
+	want := strings.Repeat("0", 16)
+	if keep != 0 {
+		want = "0000000000001000"
+	}
+	for _, field := range []string{"CapEff", "CapPrm", "CapAmb"} {
+		for _, caps := range threadStatus(t, field) {
+			if caps != want {
+				t.Errorf("thread has %s %s, want %s", field, caps, want)
+			}
+		}
+	}
+	if err := syscall.Setuid(0); err == nil {
+		t.Errorf("could switch back to root")
+	}
+	// what an upgraded process does
+	if err := dropPrivileges(65534, 65534, keep); err != nil {
+		t.Errorf("dropPrivileges() again: %v", err)
+	}
+}
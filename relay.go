@@ -0,0 +1,220 @@
+//
+// relay.go - Moving bytes between the two ends of a tunnel
+//
+// Copyright (C) 2013 Ryan A. Chapman. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+//      this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+//      this list of conditions and the following disclaimer in the documentation
+//      and/or other materials provided with the distribution.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHORS
+// OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+// When both ends are plain TCP sockets, data is moved with splice(2) through
+// a pipe and never copied into user space. The pipe is only taken from the
+// pool once the source is readable, so idle tunnels don't hold one (or its
+// two fds). Anything else is copied through a pooled 32KB buffer.
+//
+
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+const (
+	SPLICE_F_MOVE     = 0x1
+	SPLICE_F_NONBLOCK = 0x2
+	relayBufSize      = 32 * 1024
+	spliceChunk       = 1 << 20
+	// pipes kept around for reuse, the rest are closed after use
+	maxIdlePipes = 256
+)
+
+var gRelayBufs = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, relayBufSize)
+		return &b
+	},
+}
+
+type splicePipe struct {
+	r, w int
+}
+
+// not a sync.Pool, which would drop pipes without closing their fds
+var gSplicePipes = make(chan *splicePipe, maxIdlePipes)
+
+func getSplicePipe() (*splicePipe, error) {
+	select {
+	case p := <-gSplicePipes:
+		return p, nil
+	default:
+	}
+	var fds [2]int
+	if err := syscall.Pipe2(fds[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return nil, os.NewSyscallError("pipe2", err)
+	}
+	return &splicePipe{r: fds[0], w: fds[1]}, nil
+}
+
+// putSplicePipe returns p to the pool. It must be empty.
+func putSplicePipe(p *splicePipe) {
+	select {
+	case gSplicePipes <- p:
+	default:
+		p.close()
+	}
+}
+
+func (p *splicePipe) close() {
+	syscall.Close(p.r)
+	syscall.Close(p.w)
+}
+
+// relayCopy copies from src to dst until EOF, like io.Copy.
+func relayCopy(dst io.Writer, src io.Reader) (int64, error) {
+	if d, ok := dst.(*net.TCPConn); ok {
+		if s, ok := src.(*net.TCPConn); ok {
+			return spliceCopy(d, s)
+		}
+	}
+	buf := gRelayBufs.Get().(*[]byte)
+	defer gRelayBufs.Put(buf)
+	// hide ReadFrom and WriteTo, which would allocate their own buffer
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+}
+
+func spliceCopy(dst, src *net.TCPConn) (int64, error) {
+	srcRC, err := src.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	dstRC, err := dst.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var written int64
+	for {
+		if err := waitReadable(srcRC); err != nil {
+			return written, relayOpError("read", src, err)
+		}
+		p, err := getSplicePipe()
+		if err != nil {
+			return written, err
+		}
+		n, err := spliceToPipe(srcRC, p)
+		if err != nil || n == 0 {
+			// nothing is left in the pipe, it can be reused
+			putSplicePipe(p)
+			if err != nil {
+				return written, relayOpError("read", src, err)
+			}
+			return written, nil
+		}
+		for n > 0 {
+			m, err := spliceFromPipe(dstRC, p, n)
+			written += m
+			n -= m
+			if err == nil && m == 0 {
+				err = io.ErrShortWrite
+			}
+			if err != nil {
+				// the pipe may still hold data, so don't reuse it
+				p.close()
+				return written, relayOpError("write", dst, err)
+			}
+		}
+		putSplicePipe(p)
+	}
+}
+
+// waitReadable blocks until fd has data or EOF pending, without reading any
+// of it. Peeking consumes a pending socket error, so that is returned.
+func waitReadable(rc syscall.RawConn) error {
+	var b [1]byte
+	var perr error
+	err := rc.Read(func(fd uintptr) bool {
+		for {
+			_, _, perr = syscall.Recvfrom(int(fd), b[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+			if perr != syscall.EINTR {
+				return perr != syscall.EAGAIN
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if perr != nil {
+		return os.NewSyscallError("recvfrom", perr)
+	}
+	return nil
+}
+
+func spliceToPipe(rc syscall.RawConn, p *splicePipe) (int64, error) {
+	var n int64
+	var serr error
+	err := rc.Read(func(fd uintptr) bool {
+		for {
+			n, serr = syscall.Splice(int(fd), nil, p.w, nil, spliceChunk, SPLICE_F_MOVE|SPLICE_F_NONBLOCK)
+			if serr != syscall.EINTR {
+				return serr != syscall.EAGAIN
+			}
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	if serr != nil {
+		return 0, os.NewSyscallError("splice", serr)
+	}
+	return n, nil
+}
+
+func spliceFromPipe(rc syscall.RawConn, p *splicePipe, max int64) (int64, error) {
+	var n int64
+	var serr error
+	err := rc.Write(func(fd uintptr) bool {
+		for {
+			n, serr = syscall.Splice(p.r, nil, int(fd), nil, int(max), SPLICE_F_MOVE|SPLICE_F_NONBLOCK)
+			if serr != syscall.EINTR {
+				return serr != syscall.EAGAIN
+			}
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	if serr != nil {
+		return 0, os.NewSyscallError("splice", serr)
+	}
+	return n, nil
+}
+
+// relayOpError makes splice errors look like the ones io.Copy returns, which
+// is what copy() counts them by.
+func relayOpError(op string, c *net.TCPConn, err error) error {
+	if operr, ok := err.(*net.OpError); ok {
+		err = operr.Err
+	}
+	return &net.OpError{Op: op, Net: "tcp", Source: c.LocalAddr(), Addr: c.RemoteAddr(), Err: err}
+}
@@ -0,0 +1,412 @@
+//
+// relay_epoll.go - Relaying tunnels from an epoll loop instead of goroutines
+//
+// Copyright (C) 2013 Ryan A. Chapman. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+//      this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+//      this list of conditions and the following disclaimer in the documentation
+//      and/or other materials provided with the distribution.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHORS
+// OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+// With -relay=epoll, both sockets of a tunnel are added to one epoll set,
+// one-shot, and a small pool of workers does the reading and writing when
+// they become ready. An idle tunnel costs no goroutine and no buffer: a
+// buffer is taken from the pool when a socket is readable and given back as
+// soon as everything read has been written. If the other side can't take it
+// all, the rest waits for EPOLLOUT and the source isn't read from meanwhile.
+//
+// Everything else works like copy() does: EOF is passed on as a half-close,
+// errors close both connections and are counted the same way, and the
+// tunnel is logged and untracked once both directions are done.
+//
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+
+	log "github.com/zdannar/flogger"
+)
+
+const (
+	relayGoroutine = "goroutine"
+	relayEpoll     = "epoll"
+)
+
+const (
+	EPOLLRDHUP = 0x2000
+	// buffers relayed in a row before a tunnel goes back to waiting
+	epollPumpBudget = 64
+)
+
+func checkRelayMode(mode string) error {
+	if mode != relayGoroutine && mode != relayEpoll {
+		return fmt.Errorf("relay mode must be %s or %s, not %q", relayGoroutine, relayEpoll, mode)
+	}
+	return nil
+}
+
+type epollRelay struct {
+	epfd int
+	jobs chan *epollEnd // ends that are ready
+
+	mu   sync.Mutex
+	ends map[uint64]*epollEnd
+	next uint64
+}
+
+// one socket of a tunnel
+type epollEnd struct {
+	et   *epollTunnel
+	id   uint64
+	idx  int // 0 for the client, 1 for the server
+	conn *net.TCPConn
+	rc   syscall.RawConn
+	name string // name for copy(): "client", "proxyserver" or "directserver"
+}
+
+// one direction of a tunnel
+type epollDir struct {
+	src, dst *epollEnd
+	buf      *[]byte
+	pending  []byte // read from src, not yet written to dst
+	done     bool
+}
+
+type epollTunnel struct {
+	r *epollRelay
+	t *tunnel
+
+	mu       sync.Mutex
+	ends     [2]*epollEnd
+	dirs     [2]*epollDir // dirs[i] reads from ends[i]
+	first    string       // how the first direction to finish ended
+	finished bool
+}
+
+var gEpollRelay *epollRelay
+var gEpollRelayOnce sync.Once
+var gEpollRelayErr error
+
+func getEpollRelay() (*epollRelay, error) {
+	gEpollRelayOnce.Do(func() {
+		gEpollRelay, gEpollRelayErr = newEpollRelay(runtime.GOMAXPROCS(0))
+	})
+	return gEpollRelay, gEpollRelayErr
+}
+
+func newEpollRelay(workers int) (*epollRelay, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("epoll_create1", err)
+	}
+	r := &epollRelay{
+		epfd: epfd,
+		jobs: make(chan *epollEnd, 1024),
+		ends: make(map[uint64]*epollEnd),
+	}
+	for i := 0; i < workers; i++ {
+		go r.work()
+	}
+	go r.poll()
+	return r, nil
+}
+
+// relayEpollTunnel hands t to the epoll relay. It returns false if it can't,
+// in which case t must be relayed by goroutines.
+func relayEpollTunnel(t *tunnel, servername string) bool {
+	client, ok := t.client.(*net.TCPConn)
+	if !ok {
+		return false
+	}
+	server, ok := t.server.(*net.TCPConn)
+	if !ok {
+		return false
+	}
+	r, err := getEpollRelay()
+	if err != nil {
+		log.Infof("ERR: epoll relay is unavailable, using goroutines: %v", err)
+		return false
+	}
+
+	et := &epollTunnel{r: r, t: t}
+	for i, c := range []*net.TCPConn{client, server} {
+		rc, err := c.SyscallConn()
+		if err != nil {
+			return false
+		}
+		et.ends[i] = &epollEnd{et: et, idx: i, conn: c, rc: rc, name: "client"}
+	}
+	et.ends[1].name = servername
+	et.dirs[0] = &epollDir{src: et.ends[0], dst: et.ends[1]}
+	et.dirs[1] = &epollDir{src: et.ends[1], dst: et.ends[0]}
+
+	r.mu.Lock()
+	for _, e := range et.ends {
+		r.next++
+		e.id = r.next
+		r.ends[e.id] = e
+	}
+	r.mu.Unlock()
+
+	t.setCloseHook(et.killed)
+	et.mu.Lock()
+	for _, e := range et.ends {
+		et.arm(e, syscall.EPOLL_CTL_ADD)
+	}
+	et.mu.Unlock()
+	if t.isClosed() {
+		// closed before the hook was in place
+		et.killed()
+	}
+	return true
+}
+
+func (r *epollRelay) poll() {
+	events := make([]syscall.EpollEvent, 256)
+	ready := make([]*epollEnd, 0, len(events))
+	for {
+		n, err := syscall.EpollWait(r.epfd, events, -1)
+		if err != nil {
+			if err != syscall.EINTR {
+				log.Infof("ERR: epoll_wait: %v", err)
+			}
+			continue
+		}
+		ready = ready[:0]
+		r.mu.Lock()
+		for _, ev := range events[:n] {
+			id := uint64(uint32(ev.Fd)) | uint64(uint32(ev.Pad))<<32
+			if e := r.ends[id]; e != nil {
+				ready = append(ready, e)
+			}
+		}
+		r.mu.Unlock()
+		for _, e := range ready {
+			r.jobs <- e
+		}
+	}
+}
+
+func (r *epollRelay) work() {
+	for e := range r.jobs {
+		e.et.service(e)
+	}
+}
+
+// arm (re)registers e for whatever it is waiting for. et.mu must be held.
+func (et *epollTunnel) arm(e *epollEnd, op int) {
+	var events uint32
+	if d := et.dirs[e.idx]; !d.done && d.pending == nil {
+		events |= syscall.EPOLLIN | EPOLLRDHUP
+	}
+	if d := et.dirs[1-e.idx]; !d.done && d.pending != nil {
+		events |= syscall.EPOLLOUT
+	}
+	if events == 0 && op == syscall.EPOLL_CTL_MOD {
+		return
+	}
+	ev := syscall.EpollEvent{Events: events | syscall.EPOLLONESHOT, Fd: int32(uint32(e.id)), Pad: int32(uint32(e.id >> 32))}
+	// if the connection is closed, so is the fd, and it is gone from the epoll set
+	e.rc.Control(func(fd uintptr) {
+		syscall.EpollCtl(et.r.epfd, op, int(fd), &ev)
+	})
+}
+
+// service is called by a worker when e is ready.
+func (et *epollTunnel) service(e *epollEnd) {
+	et.mu.Lock()
+	if et.finished {
+		et.mu.Unlock()
+		return
+	}
+	if d := et.dirs[1-e.idx]; !d.done && d.pending != nil {
+		et.flush(d)
+	}
+	if d := et.dirs[e.idx]; !d.done && d.pending == nil {
+		// keep going while data flows, but let other tunnels have a turn
+		for i := 0; i < epollPumpBudget && et.pump(d); i++ {
+		}
+	}
+	if !et.dirs[0].done || !et.dirs[1].done {
+		et.arm(et.ends[0], syscall.EPOLL_CTL_MOD)
+		et.arm(et.ends[1], syscall.EPOLL_CTL_MOD)
+		et.mu.Unlock()
+		return
+	}
+	et.finished = true
+	first := et.first
+	et.unregister()
+	et.mu.Unlock()
+
+	et.t.close()
+	et.t.relayDone(first)
+}
+
+// pump reads what is available from d.src and writes as much of it as it can
+// to d.dst. It returns true if all of it was written and there may be more.
+func (et *epollTunnel) pump(d *epollDir) bool {
+	buf := gRelayBufs.Get().(*[]byte)
+	var n int
+	var rerr error
+	err := d.src.rc.Read(func(fd uintptr) bool {
+		for {
+			n, rerr = syscall.Read(int(fd), *buf)
+			if rerr != syscall.EINTR {
+				return true
+			}
+		}
+	})
+	if err == nil && rerr != nil {
+		err = os.NewSyscallError("read", rerr)
+	}
+	switch {
+	case rerr == syscall.EAGAIN:
+		gRelayBufs.Put(buf)
+	case err != nil:
+		gRelayBufs.Put(buf)
+		et.fail(d, relayOpError("read", d.src.conn, err))
+	case n == 0:
+		gRelayBufs.Put(buf)
+		et.eof(d)
+	default:
+		d.buf = buf
+		d.pending = (*buf)[:n]
+		et.flush(d)
+		return !d.done && d.pending == nil
+	}
+	return false
+}
+
+// flush writes as much of d.pending to d.dst as it will take right now.
+func (et *epollTunnel) flush(d *epollDir) {
+	for len(d.pending) > 0 {
+		var n int
+		var werr error
+		err := d.dst.rc.Write(func(fd uintptr) bool {
+			for {
+				n, werr = syscall.Write(int(fd), d.pending)
+				if werr != syscall.EINTR {
+					return true
+				}
+			}
+		})
+		if err == nil && werr != nil {
+			err = os.NewSyscallError("write", werr)
+		}
+		if werr == syscall.EAGAIN {
+			return
+		}
+		if err != nil {
+			et.fail(d, relayOpError("write", d.dst.conn, err))
+			return
+		}
+		d.pending = d.pending[n:]
+	}
+	et.release(d)
+}
+
+func (et *epollTunnel) release(d *epollDir) {
+	if d.buf != nil {
+		gRelayBufs.Put(d.buf)
+	}
+	d.buf = nil
+	d.pending = nil
+}
+
+// eof passes the FIN from d.src on to d.dst, like copy() does.
+func (et *epollTunnel) eof(d *epollDir) {
+	d.done = true
+	if et.first == "" {
+		et.first = et.t.endedBy(d.src.name, nil)
+	}
+	if !halfClose(d.dst.conn, d.src.conn) {
+		et.closeConns()
+		for _, o := range et.dirs {
+			if !o.done {
+				et.fail(o, relayOpError("read", o.src.conn, net.ErrClosed))
+			}
+		}
+	}
+}
+
+// fail counts err and closes both connections, like copy() does. The other
+// direction then fails too, as its copy() would.
+func (et *epollTunnel) fail(d *epollDir, err error) {
+	d.done = true
+	et.release(d)
+	countCopyError(err, d.dst.name, d.src.name)
+	if et.first == "" {
+		et.first = et.t.endedBy(d.src.name, err)
+	}
+	et.closeConns()
+	for _, o := range et.dirs {
+		if !o.done {
+			et.fail(o, relayOpError("read", o.src.conn, net.ErrClosed))
+		}
+	}
+}
+
+func (et *epollTunnel) closeConns() {
+	et.ends[0].conn.Close()
+	et.ends[1].conn.Close()
+}
+
+// unregister forgets et's ends. et.mu must be held.
+func (et *epollTunnel) unregister() {
+	for _, d := range et.dirs {
+		et.release(d)
+	}
+	et.r.mu.Lock()
+	for _, e := range et.ends {
+		delete(et.r.ends, e.id)
+	}
+	et.r.mu.Unlock()
+}
+
+// killed is the tunnel's close hook: something other than the relay closed
+// it, so no more events will come and it has to be finished here.
+func (et *epollTunnel) killed() {
+	et.mu.Lock()
+	if et.finished {
+		et.mu.Unlock()
+		return
+	}
+	et.finished = true
+	for _, d := range et.dirs {
+		if !d.done {
+			d.done = true
+			err := relayOpError("read", d.src.conn, net.ErrClosed)
+			countCopyError(err, d.dst.name, d.src.name)
+			if et.first == "" {
+				et.first = et.t.endedBy(d.src.name, err)
+			}
+		}
+	}
+	first := et.first
+	et.unregister()
+	et.mu.Unlock()
+
+	et.t.relayDone(first)
+}
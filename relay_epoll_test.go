@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func withRelayMode(t testing.TB, mode string) {
+	orig := currentConfig()
+	cfg := &proxyConfig{}
+	if orig != nil {
+		*cfg = *orig
+	}
+	cfg.relayMode = mode
+	setConfig(cfg)
+	t.Cleanup(func() { setConfig(orig) })
+}
+
+// startTestTunnel relays a tunnel between two TCP pairs and returns the
+// outer ends, the tunnel and a channel closed once it is done.
+func startTestTunnel(t *testing.T, mode string) (client, server *net.TCPConn, tun *tunnel, done chan bool) {
+	withRelayMode(t, mode)
+	client, clientSide := tcpPair(t)
+	serverSide, server := tcpPair(t)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	tun = trackTunnel(clientSide, serverSide, "192.0.2.1:7", viaDirect)
+	done = make(chan bool)
+	tun.whenDone(func() { close(done) })
+	go relayTunnel(tun, tun.serverName())
+	return
+}
+
+func waitDone(t *testing.T, done chan bool) {
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("tunnel was not done in time")
+	}
+}
+
+func TestRelayModesHalfClose(t *testing.T) {
+	for _, mode := range []string{relayGoroutine, relayEpoll} {
+		client, server, _, done := startTestTunnel(t, mode)
+
+		client.Write([]byte("request"))
+		client.CloseWrite()
+		server.SetReadDeadline(time.Now().Add(5 * time.Second))
+		req, err := io.ReadAll(server)
+		if err != nil || string(req) != "request" {
+			t.Fatalf("%s: server read %q, %v, want the request followed by EOF", mode, req, err)
+		}
+		server.Write([]byte("response"))
+		server.CloseWrite()
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		resp, err := io.ReadAll(client)
+		if err != nil || string(resp) != "response" {
+			t.Errorf("%s: client read %q, %v, want the response", mode, resp, err)
+		}
+		waitDone(t, done)
+	}
+}
+
+// Both directions at once, with a reader that can't keep up at first, so
+// the relay has to hold data back.
+func TestRelayModesBulk(t *testing.T) {
+	for _, mode := range []string{relayGoroutine, relayEpoll} {
+		client, server, _, done := startTestTunnel(t, mode)
+		up := make([]byte, 8<<20)
+		down := make([]byte, 8<<20)
+		rand.Read(up)
+		rand.Read(down)
+
+		go func() {
+			client.Write(up)
+			client.CloseWrite()
+		}()
+		go func() {
+			server.Write(down)
+			server.CloseWrite()
+		}()
+		time.Sleep(100 * time.Millisecond)
+
+		gotDown := make(chan []byte)
+		go func() {
+			client.SetReadDeadline(time.Now().Add(10 * time.Second))
+			b, _ := io.ReadAll(client)
+			gotDown <- b
+		}()
+		server.SetReadDeadline(time.Now().Add(10 * time.Second))
+		gotUp, _ := io.ReadAll(server)
+		if !bytes.Equal(gotUp, up) {
+			t.Errorf("%s: server got %d bytes that don't match the %d sent", mode, len(gotUp), len(up))
+		}
+		if b := <-gotDown; !bytes.Equal(b, down) {
+			t.Errorf("%s: client got %d bytes that don't match the %d sent", mode, len(b), len(down))
+		}
+		waitDone(t, done)
+	}
+}
+
+func TestRelayModesServerReset(t *testing.T) {
+	var counted [2]uint64
+	for i, mode := range []string{relayGoroutine, relayEpoll} {
+		// read before the relay starts, the counters are read without locking
+		before := numDirectServerReadErr()
+		client, server, tun, done := startTestTunnel(t, mode)
+		server.SetLinger(0)
+		server.Close()
+		waitDone(t, done)
+		counted[i] = numDirectServerReadErr() - before
+
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := client.Read(make([]byte, 1)); err == nil {
+			t.Errorf("%s: client connection still open after the server reset", mode)
+		}
+		if !tun.isClosed() {
+			t.Errorf("%s: tunnel not closed after the server reset", mode)
+		}
+	}
+	if counted[0] != 1 || counted[1] != counted[0] {
+		t.Errorf("server read errors counted: goroutine %d, epoll %d, want 1 each", counted[0], counted[1])
+	}
+}
+
+func TestRelayModesKill(t *testing.T) {
+	for _, mode := range []string{relayGoroutine, relayEpoll} {
+		client, _, tun, done := startTestTunnel(t, mode)
+		time.Sleep(10 * time.Millisecond)
+		if !closeTunnel(tun.id) {
+			t.Fatalf("%s: tunnel %d not found", mode, tun.id)
+		}
+		waitDone(t, done)
+		for _, active := range activeTunnels() {
+			if active == tun {
+				t.Errorf("%s: killed tunnel is still tracked", mode)
+			}
+		}
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := client.Read(make([]byte, 1)); err == nil {
+			t.Errorf("%s: client connection still open after the tunnel was killed", mode)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// plainConn hides the *net.TCPConn, so relayCopy has to use a buffer.
+type plainConn struct {
+	net.Conn
+}
+
+func testRelayCopy(t *testing.T, wrap bool) {
+	client, clientSide := tcpPair(t)
+	defer client.Close()
+	defer clientSide.Close()
+	serverSide, server := tcpPair(t)
+	defer serverSide.Close()
+	defer server.Close()
+
+	var dst io.Writer = serverSide
+	var src io.Reader = clientSide
+	if wrap {
+		dst, src = plainConn{serverSide}, plainConn{clientSide}
+	}
+	type result struct {
+		n   int64
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		n, err := relayCopy(dst, src)
+		serverSide.CloseWrite()
+		done <- result{n, err}
+	}()
+
+	data := make([]byte, 4<<20)
+	rand.Read(data)
+	go func() {
+		client.Write(data)
+		client.CloseWrite()
+	}()
+	server.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatalf("reading relayed data: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("relayed %d bytes that don't match the %d sent", len(got), len(data))
+	}
+	r := <-done
+	if r.err != nil || r.n != int64(len(data)) {
+		t.Errorf("relayCopy() = %d, %v, want %d, nil", r.n, r.err, len(data))
+	}
+}
+
+func TestRelayCopySplice(t *testing.T) {
+	testRelayCopy(t, false)
+}
+
+func TestRelayCopyBuffered(t *testing.T) {
+	testRelayCopy(t, true)
+}
+
+func TestRelayCopyReset(t *testing.T) {
+	client, clientSide := tcpPair(t)
+	defer clientSide.Close()
+	serverSide, server := tcpPair(t)
+	defer serverSide.Close()
+	defer server.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := relayCopy(serverSide, clientSide)
+		done <- err
+	}()
+	client.SetLinger(0)
+	client.Close()
+
+	select {
+	case err := <-done:
+		operr, ok := err.(*net.OpError)
+		if !ok || operr.Op != "read" {
+			t.Errorf("relayCopy() = %v after a reset, want a read error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("relayCopy() did not return after the source was reset")
+	}
+}
+
+func benchmarkRelay(b *testing.B, wrap bool) {
+	client, clientSide := tcpPair(b)
+	defer client.Close()
+	serverSide, server := tcpPair(b)
+	defer server.Close()
+
+	tun := trackTunnel(clientSide, serverSide, "192.0.2.1:7", viaDirect)
+	if wrap {
+		tun.client, tun.server = plainConn{clientSide}, plainConn{serverSide}
+	}
+	go relayTunnel(tun, "directserver")
+
+	chunk := make([]byte, 64*1024)
+	b.SetBytes(int64(len(chunk)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			client.Write(chunk)
+		}
+		client.CloseWrite()
+	}()
+	io.Copy(io.Discard, server)
+}
+
+func BenchmarkRelaySplice(b *testing.B) {
+	benchmarkRelay(b, false)
+}
+
+func BenchmarkRelayBuffered(b *testing.B) {
+	benchmarkRelay(b, true)
+}
+
+func BenchmarkRelayEpoll(b *testing.B) {
+	withRelayMode(b, relayEpoll)
+	benchmarkRelay(b, false)
+}
+
+// BenchmarkRelayIdleTunnels reports the memory held by idle tunnels in each
+// relay mode, scaled to 10k tunnels if the fd limit doesn't allow that many.
+func BenchmarkRelayIdleTunnels(b *testing.B) {
+	for _, mode := range []string{relayGoroutine, relayEpoll} {
+		b.Run(mode, func(b *testing.B) {
+			withRelayMode(b, mode)
+			benchmarkIdleTunnels(b)
+		})
+	}
+}
+
+func benchmarkIdleTunnels(b *testing.B) {
+	n := 10000
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err == nil {
+		// four sockets per tunnel
+		if max := int(rlim.Cur-200) / 4; max < n {
+			n = max
+		}
+	}
+
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatalf("could not listen: %v", err)
+	}
+	defer l.Close()
+	pair := func() (*net.TCPConn, *net.TCPConn) {
+		c, err := net.DialTCP("tcp", nil, l.Addr().(*net.TCPAddr))
+		if err != nil {
+			b.Fatalf("could not connect: %v", err)
+		}
+		s, err := l.AcceptTCP()
+		if err != nil {
+			b.Fatalf("could not accept: %v", err)
+		}
+		return c, s
+	}
+
+	for i := 0; i < b.N; i++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		goroutines := runtime.NumGoroutine()
+
+		var ends []net.Conn
+		for j := 0; j < n; j++ {
+			client, clientSide := pair()
+			serverSide, server := pair()
+			ends = append(ends, client, server)
+			go relayTunnel(trackTunnel(clientSide, serverSide, "192.0.2.1:7", viaDirect), "directserver")
+		}
+		time.Sleep(100 * time.Millisecond)
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+
+		perTunnel := float64(after.HeapInuse+after.StackInuse-before.HeapInuse-before.StackInuse) / float64(n)
+		b.ReportMetric(perTunnel, "B/tunnel")
+		b.ReportMetric(perTunnel*10000/(1<<20), "MB/10k-tunnels")
+		b.ReportMetric(float64(runtime.NumGoroutine()-goroutines)/float64(n), "goroutines/tunnel")
+
+		for _, c := range ends {
+			c.Close()
+		}
+		for numActiveTunnels() > 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
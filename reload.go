@@ -0,0 +1,205 @@
+//
+// reload.go - Reload the configuration on SIGHUP without dropping tunnels
+//
+// Copyright (C) 2013 Ryan A. Chapman. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+//      this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+//      this list of conditions and the following disclaimer in the documentation
+//      and/or other materials provided with the distribution.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHORS
+// OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+// A reload parses the command line and the -config file again, exactly like
+// startup does, builds a new proxyConfig from the result and swaps it in.
+// If anything is wrong with the new configuration, nothing is changed and
+// the running configuration is kept.
+//
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/namsral/flag"
+	log "github.com/zdannar/flogger"
+)
+
+// Flags that can be changed by a reload. Everything else needs a restart.
+var reloadableFlags = []string{"d", "p", "r", "R", "s", "S", "v", "hostsniff", "httpports", "classify",
+	"maxtunnels", "maxperclient", "maxperdest", "clientmask", "clientrate", "clientburst", "overlimit", "queuetimeout", "relay", "credentials", "rules", "verifyname"}
+
+func setupReload() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for _ = range c {
+			reload()
+		}
+	}()
+}
+
+// reload re-reads everything that can be changed without a restart. This is
+// what SIGHUP and the admin API's /reload do.
+func reload() error {
+	sdNotifyf("RELOADING=1\nMONOTONIC_USEC=%d", monotonicUsec())
+	defer sdNotifyf("READY=1\n%s", sdStatus())
+	reopenLogs()
+	log.Infof("Reloading configuration")
+	if err := reloadConfig(os.Args[1:]); err != nil {
+		log.Infof("ERR: Reload failed, keeping the running configuration: %v", err)
+		return err
+	}
+	log.Infof("Reloaded configuration")
+	return nil
+}
+
+func reloadConfig(args []string) error {
+	gConfigUpdate.Lock()
+	defer gConfigUpdate.Unlock()
+
+	vals, err := parseFlagValues(args)
+	if err != nil {
+		return err
+	}
+	cfg, err := loadConfig(vals)
+	if err != nil {
+		return err
+	}
+
+	// Everything checked out. Keep the flag variables in sync with what is
+	// running, then switch new connections over to the new configuration.
+	for _, name := range reloadableFlags {
+		flag.Set(name, vals[name])
+	}
+	if cfg.reverseLookups {
+		setupReverseLookups()
+	}
+	if gVerbosity != 0 {
+		log.SetLevel(log.DEBUG)
+	} else {
+		log.SetLevel(log.INFO)
+	}
+	setConfig(cfg)
+
+	var ignored []string
+	flag.VisitAll(func(f *flag.Flag) {
+		if v, ok := vals[f.Name]; ok && v != f.Value.String() {
+			ignored = append(ignored, f.Name)
+		}
+	})
+	sort.Strings(ignored)
+	for _, name := range ignored {
+		log.Infof("Reload: -%s has changed, but only takes effect after a restart", name)
+	}
+	return nil
+}
+
+// parseFlagValues parses args and the -config file they name into a fresh
+// flag set, leaving the running flag variables untouched.
+func parseFlagValues(args []string) (map[string]string, error) {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	flag.VisitAll(func(f *flag.Flag) {
+		fs.String(f.Name, f.DefValue, f.Usage)
+	})
+	if err := parseArgs(fs, args); err != nil {
+		return nil, err
+	}
+	vals := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		vals[f.Name] = f.Value.String()
+	})
+	return vals, nil
+}
+
+// loadConfig builds a proxyConfig from the reloadable flag values, checking
+// the upstream proxies unless -s=1.
+func loadConfig(vals map[string]string) (*proxyConfig, error) {
+	ints := make(map[string]int)
+	for _, name := range []string{"r", "R", "s", "S", "v", "hostsniff", "classify", "maxtunnels", "maxperclient", "maxperdest", "clientmask", "clientburst"} {
+		n, err := strconv.Atoi(vals[name])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q for -%s: %v", vals[name], name, err)
+		}
+		ints[name] = n
+	}
+
+	creds, err := loadCredentials(vals["credentials"], os.Environ())
+	if err != nil {
+		return nil, fmt.Errorf("invalid -credentials: %v", err)
+	}
+	proxyServers, authProxyServers, err := parseProxies(vals["p"], creds, ints["s"] != 1)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := newProxyConfig(proxyServers, authProxyServers, splitDirects(vals["d"]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid -d: %v", err)
+	}
+	cfg.clientRedirects = ints["r"] == 1
+	cfg.reverseLookups = ints["R"] == 1
+	cfg.sniParsing = ints["S"] == 1
+	cfg.hostSniffing = ints["hostsniff"] == 1
+	cfg.classify = ints["classify"] == 1
+	rules, err := loadRules(vals["rules"], creds)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -rules: %v", err)
+	}
+	cfg = cfg.withRules(rules)
+	if cfg.httpPorts, err = parseHTTPPorts(vals["httpports"]); err != nil {
+		return nil, fmt.Errorf("invalid -httpports: %v", err)
+	}
+
+	clientRate, err := strconv.ParseFloat(vals["clientrate"], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q for -clientrate: %v", vals["clientrate"], err)
+	}
+	queueTimeout, err := time.ParseDuration(vals["queuetimeout"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q for -queuetimeout: %v", vals["queuetimeout"], err)
+	}
+	cfg.limits = connLimits{
+		maxTunnels:   ints["maxtunnels"],
+		maxPerClient: ints["maxperclient"],
+		maxPerDest:   ints["maxperdest"],
+		clientMask:   ints["clientmask"],
+		clientRate:   clientRate,
+		clientBurst:  ints["clientburst"],
+		overLimit:    vals["overlimit"],
+		queueTimeout: queueTimeout,
+	}
+	if err := cfg.limits.check(); err != nil {
+		return nil, err
+	}
+	if err := checkRelayMode(vals["relay"]); err != nil {
+		return nil, err
+	}
+	cfg.relayMode = vals["relay"]
+	if err := checkVerifyPolicy(vals["verifyname"]); err != nil {
+		return nil, fmt.Errorf("invalid -verifyname: %v", err)
+	}
+	cfg.verifyPolicy = vals["verifyname"]
+	return cfg, nil
+}
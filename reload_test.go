@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestFile writes contents to a file called name in a fresh temporary
+// directory and returns its path.
+func writeTestFile(t *testing.T, name, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("could not write %s: %v", name, err)
+	}
+	return path
+}
+
+func TestReloadConfig(t *testing.T) {
+	orig, _ := newProxyConfig([]string{"10.1.1.1:3128"}, nil, nil)
+	setConfig(orig)
+	defer func() { gProxyServerSpec, gDirects, gSkipCheckUpstreamsReachable, gSNIParsing = "", "", 0, 0 }()
+
+	path := writeTestFile(t, "any_proxy.conf", "p user:pass@10.2.2.2:3128,10.3.3.3:8080\nd 1.2.3.0/24\ns 1\nS 1\n")
+	if err := reloadConfig([]string{"-config", path, "-l", ":3128"}); err != nil {
+		t.Fatalf("reloadConfig() failed: %v", err)
+	}
+
+	cfg := currentConfig()
+	if len(cfg.proxyServers) != 2 || cfg.proxyServers[0] != "10.2.2.2:3128" || cfg.proxyServers[1] != "10.3.3.3:8080" {
+		t.Errorf("proxyServers = %v, want [10.2.2.2:3128 10.3.3.3:8080]", cfg.proxyServers)
+	}
+	if cfg.authProxyServers["10.2.2.2:3128"] != "dXNlcjpwYXNz" {
+		t.Errorf("authProxyServers = %v, want credentials for 10.2.2.2:3128", cfg.authProxyServers)
+	}
+	ip := net.ParseIP("1.2.3.4")
+	if ok, _ := cfg.director(&ip); !ok {
+		t.Errorf("%s should go direct after reload", ip)
+	}
+	if !cfg.sniParsing {
+		t.Errorf("-S=1 was not picked up by the reload")
+	}
+	if gProxyServerSpec != "user:pass@10.2.2.2:3128,10.3.3.3:8080" {
+		t.Errorf("gProxyServerSpec = %q, was not updated by the reload", gProxyServerSpec)
+	}
+}
+
+func TestReloadBadConfigKeepsRunningConfig(t *testing.T) {
+	orig, _ := newProxyConfig([]string{"10.1.1.1:3128"}, nil, []string{"1.2.3.4"})
+	setConfig(orig)
+
+	badConfigs := []string{
+		"d 1.2.3.0/99\ns 1\n",
+		"S yes\n",
+		"nosuchflag 1\n",
+	}
+	for _, contents := range badConfigs {
+		path := writeTestFile(t, "any_proxy.conf", contents)
+		if err := reloadConfig([]string{"-config", path}); err == nil {
+			t.Errorf("reloadConfig() accepted bad config %q", contents)
+		}
+		if currentConfig() != orig {
+			t.Errorf("bad config %q replaced the running configuration", contents)
+		}
+	}
+}
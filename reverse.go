@@ -0,0 +1,389 @@
+//
+// reverse.go - Reverse lookups of destination addresses (-R) and their cache
+//
+// Copyright (C) 2013 Ryan A. Chapman. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+//      this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+//      this list of conditions and the following disclaimer in the documentation
+//      and/or other materials provided with the distribution.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHORS
+// OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+// With -R=1, the destination address of a proxied connection is looked up
+// (PTR) so that the CONNECT request can name a host. Lookups are done by a pool
+// of -lookupworkers goroutines, and a connection waits at most -lookuptimeout
+// for one before going ahead with the address; the answer still goes into the
+// cache for the connections after it. Connections to the same address while
+// its lookup is running wait on that lookup rather than start another. Failed
+// lookups are cached for -lookupnegttl so that they aren't retried on every
+// connection. The cache is shared with the DNS forwarder (dns.go).
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/zdannar/flogger"
+)
+
+const (
+	defaultLookupTimeout = 500 * time.Millisecond
+	defaultLookupNegTTL  = 5 * time.Minute
+	defaultLookupWorkers = 8
+
+	defaultLookupCacheSize = 65536
+	defaultLookupTTL       = time.Hour
+
+	// how long a worker waits for the resolver before giving up on a lookup
+	reverseLookupMaxTime = 10 * time.Second
+	// lookups waiting for a worker, beyond which connections don't wait
+	reverseLookupQueueLen = 1024
+)
+
+// cacheKey is the address a name is for and, for names from DNS answers, the
+// client that asked. Names from lookups have no client.
+type cacheKey struct {
+	client netip.Addr
+	addr   netip.Addr
+}
+
+type cacheEntry struct {
+	key      cacheKey
+	hostname string // "" if the lookup failed
+	expires  time.Time
+}
+
+// reverseLookupCache maps addresses to hostnames, found by lookups or, per
+// client, in the DNS answers it got. It holds up to size entries, dropping
+// the least recently used one to make room.
+type reverseLookupCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration // for lookups, DNS answers bring their own
+	entries map[cacheKey]*list.Element
+	lru     list.List // of *cacheEntry, most recently used first
+}
+
+func NewReverseLookupCache(size int, ttl time.Duration) *reverseLookupCache {
+	if size < 1 {
+		size = 1
+	}
+	return &reverseLookupCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[cacheKey]*list.Element),
+	}
+}
+
+// lookup returns the hostname cached for addr, and whether there was one. A
+// failed lookup is cached as "".
+func (c *reverseLookupCache) lookup(addr netip.Addr) (string, bool) {
+	return c.get(cacheKey{addr: addr.Unmap()})
+}
+
+// lookupClient returns the hostname client last resolved to addr through the
+// DNS forwarder, and whether there was one.
+func (c *reverseLookupCache) lookupClient(client, addr netip.Addr) (string, bool) {
+	if !client.IsValid() {
+		return "", false
+	}
+	return c.get(cacheKey{client.Unmap(), addr.Unmap()})
+}
+
+func (c *reverseLookupCache) get(key cacheKey) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el := c.entries[key]
+	if el == nil {
+		incrReverseCacheMisses()
+		return "", false
+	}
+	e := el.Value.(*cacheEntry)
+	if !e.expires.After(time.Now()) {
+		incrReverseCacheExpired()
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return "", false
+	}
+	if e.hostname == "" {
+		incrReverseCacheNegativeHits()
+	} else {
+		incrReverseCacheHits()
+	}
+	c.lru.MoveToFront(el)
+	return e.hostname, true
+}
+
+// store caches hostname for addr for the cache's TTL.
+func (c *reverseLookupCache) store(addr netip.Addr, hostname string) {
+	c.storeUntil(addr, hostname, time.Now().Add(c.ttl))
+}
+
+// storeFor caches hostname for addr for ttl.
+func (c *reverseLookupCache) storeFor(addr netip.Addr, hostname string, ttl time.Duration) {
+	c.storeUntil(addr, hostname, time.Now().Add(ttl))
+}
+
+func (c *reverseLookupCache) storeUntil(addr netip.Addr, hostname string, expires time.Time) {
+	c.put(cacheKey{addr: addr.Unmap()}, hostname, expires)
+}
+
+// storeClient caches hostname as what client resolved to addr, for ttl.
+func (c *reverseLookupCache) storeClient(client, addr netip.Addr, hostname string, ttl time.Duration) {
+	c.put(cacheKey{client.Unmap(), addr.Unmap()}, hostname, time.Now().Add(ttl))
+}
+
+func (c *reverseLookupCache) put(key cacheKey, hostname string, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el := c.entries[key]; el != nil {
+		*el.Value.(*cacheEntry) = cacheEntry{key: key, hostname: hostname, expires: expires}
+		c.lru.MoveToFront(el)
+		return
+	}
+	for c.lru.Len() >= c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, hostname: hostname, expires: expires})
+}
+
+// storeFailure caches a failed lookup of addr, unless a name is already cached
+// for it, such as one found by a lookup that finished in the meantime.
+func (c *reverseLookupCache) storeFailure(addr netip.Addr, ttl time.Duration) {
+	addr = addr.Unmap()
+	c.mu.Lock()
+	known := false
+	if el := c.entries[cacheKey{addr: addr}]; el != nil {
+		e := el.Value.(*cacheEntry)
+		known = e.hostname != "" && e.expires.After(time.Now())
+	}
+	c.mu.Unlock()
+	if !known {
+		c.storeFor(addr, "", ttl)
+	}
+}
+
+// save writes the names in the cache that haven't expired to path, one
+// "address hostname expiry" line each, followed by the client for names from
+// DNS answers, least recently used first. Failed lookups aren't saved.
+func (c *reverseLookupCache) save(path string) (int, error) {
+	var buf bytes.Buffer
+	n := 0
+	now := time.Now()
+	c.mu.Lock()
+	for el := c.lru.Back(); el != nil; el = el.Prev() {
+		e := el.Value.(*cacheEntry)
+		if e.hostname == "" || !e.expires.After(now) {
+			continue
+		}
+		if e.key.client.IsValid() {
+			fmt.Fprintf(&buf, "%s %s %d %s\n", e.key.addr, e.hostname, e.expires.Unix(), e.key.client)
+		} else {
+			fmt.Fprintf(&buf, "%s %s %d\n", e.key.addr, e.hostname, e.expires.Unix())
+		}
+		n++
+	}
+	c.mu.Unlock()
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return 0, err
+	}
+	return n, os.Rename(tmp, path)
+}
+
+// load reads back a file written by save. Entries that have expired since, or
+// that don't look right, are skipped.
+func (c *reverseLookupCache) load(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	n := 0
+	now := time.Now()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) != 3 && len(fields) != 4 {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil || checkHostname(fields[1]) != nil {
+			continue
+		}
+		secs, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil || !time.Unix(secs, 0).After(now) {
+			continue
+		}
+		key := cacheKey{addr: addr.Unmap()}
+		if len(fields) == 4 {
+			if key.client, err = netip.ParseAddr(fields[3]); err != nil {
+				continue
+			}
+			key.client = key.client.Unmap()
+		}
+		c.put(key, fields[1], time.Unix(secs, 0))
+		n++
+	}
+	return n, sc.Err()
+}
+
+var gReverseLookupCache *reverseLookupCache
+var gReverseResolver *reverseResolver
+
+// setupReverseLookups creates the cache and the lookup workers, if they
+// haven't been already.
+func setupReverseLookups() {
+	if gReverseLookupCache == nil {
+		gReverseLookupCache = NewReverseLookupCache(gLookupCacheSize, gLookupTTL)
+		if gLookupCacheFile != "" {
+			n, err := gReverseLookupCache.load(gLookupCacheFile)
+			if err != nil && !os.IsNotExist(err) {
+				log.Infof("ERR: Could not load the reverse lookup cache from %s: %v", gLookupCacheFile, err)
+			} else if err == nil {
+				log.Infof("Loaded %d names into the reverse lookup cache from %s", n, gLookupCacheFile)
+			}
+		}
+	}
+	if gReverseResolver == nil {
+		gReverseResolver = newReverseResolver(gReverseLookupCache, net.DefaultResolver.LookupAddr, gLookupWorkers, gLookupTimeout, gLookupNegTTL)
+	}
+}
+
+// saveReverseLookups writes the cache to -lookupcachefile, if there is one, so
+// that the next any_proxy process can start with it.
+func saveReverseLookups() {
+	if gReverseLookupCache == nil || gLookupCacheFile == "" {
+		return
+	}
+	n, err := gReverseLookupCache.save(gLookupCacheFile)
+	if err != nil {
+		log.Infof("ERR: Could not save the reverse lookup cache to %s: %v", gLookupCacheFile, err)
+		return
+	}
+	log.Infof("Saved %d names from the reverse lookup cache to %s", n, gLookupCacheFile)
+}
+
+// pendingLookup is a lookup that connections are waiting on.
+type pendingLookup struct {
+	done     chan bool
+	hostname string
+}
+
+type reverseResolver struct {
+	cache      *reverseLookupCache
+	lookupAddr func(ctx context.Context, ip string) ([]string, error)
+	timeout    time.Duration
+	negTTL     time.Duration
+	queue      chan netip.Addr
+
+	mu      sync.Mutex
+	pending map[netip.Addr]*pendingLookup
+}
+
+func newReverseResolver(cache *reverseLookupCache, lookupAddr func(context.Context, string) ([]string, error), workers int, timeout, negTTL time.Duration) *reverseResolver {
+	if workers < 1 {
+		workers = 1
+	}
+	r := &reverseResolver{
+		cache:      cache,
+		lookupAddr: lookupAddr,
+		timeout:    timeout,
+		negTTL:     negTTL,
+		queue:      make(chan netip.Addr, reverseLookupQueueLen),
+		pending:    make(map[netip.Addr]*pendingLookup),
+	}
+	for i := 0; i < workers; i++ {
+		go r.work()
+	}
+	return r
+}
+
+// resolve returns the hostname of ip, or "" if it has none or it couldn't be
+// found within the timeout.
+func (r *reverseResolver) resolve(ip netip.Addr) string {
+	ip = ip.Unmap()
+	if hostname, ok := r.cache.lookup(ip); ok {
+		return hostname
+	}
+	r.mu.Lock()
+	p := r.pending[ip]
+	if p == nil {
+		p = &pendingLookup{done: make(chan bool)}
+		select {
+		case r.queue <- ip:
+			r.pending[ip] = p
+		default:
+			r.mu.Unlock()
+			log.Debugf("resolve(): lookup queue full, using %s", ip)
+			incrReverseLookupTimeouts()
+			return ""
+		}
+	}
+	r.mu.Unlock()
+
+	t := time.NewTimer(r.timeout)
+	defer t.Stop()
+	select {
+	case <-p.done:
+		return p.hostname
+	case <-t.C:
+		log.Debugf("resolve(): no answer for %s within %v, using the address", ip, r.timeout)
+		incrReverseLookupTimeouts()
+		return ""
+	}
+}
+
+func (r *reverseResolver) work() {
+	for ip := range r.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), reverseLookupMaxTime)
+		names, err := r.lookupAddr(ctx, ip.String())
+		cancel()
+		hostname := ""
+		if err == nil && len(names) > 0 {
+			hostname = names[0]
+			r.cache.store(ip, hostname)
+		} else {
+			log.Debugf("work(): reverse lookup of %s failed: %v", ip, err)
+			incrReverseLookupFailures()
+			r.cache.storeFailure(ip, r.negTTL)
+		}
+
+		r.mu.Lock()
+		p := r.pending[ip]
+		delete(r.pending, ip)
+		r.mu.Unlock()
+		p.hostname = hostname
+		close(p.done)
+	}
+}
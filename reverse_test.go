@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var ip = netip.MustParseAddr
+
+func newTestCache(size int) *reverseLookupCache {
+	return NewReverseLookupCache(size, time.Minute)
+}
+
+func TestReverseLookupCacheStoreFor(t *testing.T) {
+	c := newTestCache(10)
+	c.storeFor(ip("10.1.2.3"), "a.example.com", time.Minute)
+	c.storeFor(ip("10.1.2.3"), "b.example.com", time.Minute)
+	if got, _ := c.lookup(ip("10.1.2.3")); got != "b.example.com" {
+		t.Errorf("lookup() = %q, want b.example.com", got)
+	}
+	if c.lru.Len() != 1 {
+		t.Errorf("storing an address again added another entry")
+	}
+	c.storeFor(ip("10.1.2.4"), "c.example.com", -time.Second)
+	if got, ok := c.lookup(ip("10.1.2.4")); got != "" || ok {
+		t.Errorf("lookup() of an expired entry = %q, %v", got, ok)
+	}
+	// IPv4 addresses are the same entry however they are written
+	c.store(ip("::ffff:10.1.2.5"), "d.example.com")
+	if got, _ := c.lookup(ip("10.1.2.5")); got != "d.example.com" {
+		t.Errorf("lookup() of a 4in6 address = %q, want d.example.com", got)
+	}
+	c.store(ip("2001:db8::1"), "e.example.com")
+	if got, _ := c.lookup(ip("2001:db8::1")); got != "e.example.com" {
+		t.Errorf("lookup() of an IPv6 address = %q, want e.example.com", got)
+	}
+}
+
+func TestReverseLookupCacheLRU(t *testing.T) {
+	c := newTestCache(3)
+	c.store(ip("10.0.0.1"), "a.example.com")
+	c.store(ip("10.0.0.2"), "b.example.com")
+	c.store(ip("10.0.0.3"), "c.example.com")
+	// 10.0.0.2 becomes the least recently used
+	c.lookup(ip("10.0.0.1"))
+	c.store(ip("10.0.0.4"), "d.example.com")
+	if _, ok := c.lookup(ip("10.0.0.2")); ok {
+		t.Errorf("least recently used entry was kept")
+	}
+	for _, a := range []string{"10.0.0.1", "10.0.0.3", "10.0.0.4"} {
+		if _, ok := c.lookup(ip(a)); !ok {
+			t.Errorf("%s was dropped", a)
+		}
+	}
+	if c.lru.Len() != 3 || len(c.entries) != 3 {
+		t.Errorf("cache holds %d/%d entries, want 3", c.lru.Len(), len(c.entries))
+	}
+}
+
+func TestReverseLookupCacheFailures(t *testing.T) {
+	c := newTestCache(10)
+	c.storeFailure(ip("10.1.2.3"), time.Minute)
+	if got, ok := c.lookup(ip("10.1.2.3")); got != "" || !ok {
+		t.Errorf("lookup() of a failed lookup = %q, %v, want \"\", true", got, ok)
+	}
+	c.storeFor(ip("10.1.2.4"), "dns.example.com", time.Minute)
+	c.storeFailure(ip("10.1.2.4"), time.Minute)
+	if got, _ := c.lookup(ip("10.1.2.4")); got != "dns.example.com" {
+		t.Errorf("failed lookup replaced a known name, lookup() = %q", got)
+	}
+}
+
+func TestReverseLookupCacheClients(t *testing.T) {
+	c := newTestCache(10)
+	c.store(ip("10.1.2.3"), "ptr.example.com")
+	c.storeClient(ip("192.168.1.1"), ip("10.1.2.3"), "a.example.com", time.Minute)
+	c.storeClient(ip("::ffff:192.168.1.2"), ip("10.1.2.3"), "b.example.com", time.Minute)
+	for client, want := range map[string]string{"192.168.1.1": "a.example.com", "192.168.1.2": "b.example.com", "192.168.1.3": ""} {
+		if got, _ := c.lookupClient(ip(client), ip("10.1.2.3")); got != want {
+			t.Errorf("lookupClient(%s) = %q, want %q", client, got, want)
+		}
+	}
+	if got, _ := c.lookup(ip("10.1.2.3")); got != "ptr.example.com" {
+		t.Errorf("lookup() = %q, want the PTR name", got)
+	}
+	if got, ok := c.lookupClient(netip.Addr{}, ip("10.1.2.3")); ok {
+		t.Errorf("lookupClient() without a client = %q", got)
+	}
+}
+
+func TestReverseLookupCacheSaveLoad(t *testing.T) {
+	c := newTestCache(10)
+	c.store(ip("10.0.0.1"), "a.example.com.")
+	c.storeFor(ip("2001:db8::1"), "b.example.com", time.Hour)
+	c.storeFor(ip("10.0.0.2"), "expired.example.com", -time.Second)
+	c.storeFailure(ip("10.0.0.3"), time.Minute)
+	c.storeClient(ip("192.168.1.1"), ip("10.0.0.4"), "c.example.com", time.Hour)
+	c.lookup(ip("10.0.0.1"))
+	path := filepath.Join(t.TempDir(), "names")
+	if n, err := c.save(path); n != 3 || err != nil {
+		t.Fatalf("save() = %d, %v, want 3 names", n, err)
+	}
+
+	// a line that could end up in a CONNECT request is skipped
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(f, "10.0.0.9 evil.example.com\r\nX-Evil:1 %d\ngarbage\n", time.Now().Add(time.Hour).Unix())
+	f.Close()
+
+	d := newTestCache(10)
+	if n, err := d.load(path); n != 3 || err != nil {
+		t.Fatalf("load() = %d, %v, want 3 names", n, err)
+	}
+	// the most recently used entry was saved last, so it is loaded as such
+	if e := d.lru.Front().Value.(*cacheEntry); e.key.addr != ip("10.0.0.1") {
+		t.Errorf("most recently used after load is %v", e.key.addr)
+	}
+	if got, _ := d.lookup(ip("10.0.0.1")); got != "a.example.com." {
+		t.Errorf("10.0.0.1 loaded as %q", got)
+	}
+	if got, _ := d.lookup(ip("2001:db8::1")); got != "b.example.com" {
+		t.Errorf("2001:db8::1 loaded as %q", got)
+	}
+	if got, _ := d.lookupClient(ip("192.168.1.1"), ip("10.0.0.4")); got != "c.example.com" {
+		t.Errorf("10.0.0.4 loaded as %q for 192.168.1.1", got)
+	}
+	for _, a := range []string{"10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.9"} {
+		if _, ok := d.lookup(ip(a)); ok {
+			t.Errorf("%s was loaded", a)
+		}
+	}
+}
+
+// fakeLookups answers reverse lookups once release is closed, or fails them
+// if fail is set.
+type fakeLookups struct {
+	calls   atomic.Int32
+	release chan bool
+	fail    bool
+}
+
+func (f *fakeLookups) lookupAddr(ctx context.Context, ip string) ([]string, error) {
+	f.calls.Add(1)
+	<-f.release
+	if f.fail {
+		return nil, errors.New("no such host")
+	}
+	return []string{"host-" + ip + ".example.com."}, nil
+}
+
+func TestReverseResolverCollapsesLookups(t *testing.T) {
+	f := &fakeLookups{release: make(chan bool)}
+	r := newReverseResolver(newTestCache(100), f.lookupAddr, 4, 5*time.Second, time.Minute)
+	var wg sync.WaitGroup
+	results := make([]string, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = r.resolve(ip("10.0.0.1"))
+		}(i)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(f.release)
+	wg.Wait()
+	for _, got := range results {
+		if got != "host-10.0.0.1.example.com." {
+			t.Errorf("resolve() = %q", got)
+		}
+	}
+	if n := f.calls.Load(); n != 1 {
+		t.Errorf("%d lookups done, want 1", n)
+	}
+}
+
+func TestReverseResolverTimeout(t *testing.T) {
+	f := &fakeLookups{release: make(chan bool)}
+	r := newReverseResolver(newTestCache(100), f.lookupAddr, 1, 50*time.Millisecond, time.Minute)
+	timeouts := numReverseLookupTimeouts()
+	start := time.Now()
+	if got := r.resolve(ip("10.0.0.2")); got != "" {
+		t.Errorf("resolve() = %q before the lookup finished", got)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("resolve() waited %v", d)
+	}
+	if n := numReverseLookupTimeouts() - timeouts; n != 1 {
+		t.Errorf("%d timeouts counted, want 1", n)
+	}
+	// the lookup finishes in the background and is used from then on
+	close(f.release)
+	deadline := time.Now().Add(5 * time.Second)
+	for r.resolve(ip("10.0.0.2")) == "" {
+		if time.Now().After(deadline) {
+			t.Fatalf("lookup result was never cached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReverseResolverNegativeCache(t *testing.T) {
+	f := &fakeLookups{release: make(chan bool), fail: true}
+	close(f.release)
+	r := newReverseResolver(newTestCache(100), f.lookupAddr, 1, 5*time.Second, time.Minute)
+	failures := numReverseLookupFailures()
+	for i := 0; i < 3; i++ {
+		if got := r.resolve(ip("10.0.0.3")); got != "" {
+			t.Errorf("resolve() = %q for a failed lookup", got)
+		}
+	}
+	if n := f.calls.Load(); n != 1 {
+		t.Errorf("%d lookups done, want the failure cached after 1", n)
+	}
+	if n := numReverseLookupFailures() - failures; n != 1 {
+		t.Errorf("%d failures counted, want 1", n)
+	}
+
+	r = newReverseResolver(newTestCache(100), f.lookupAddr, 1, 5*time.Second, -time.Second)
+	r.resolve(ip("10.0.0.3"))
+	r.resolve(ip("10.0.0.3"))
+	if n := f.calls.Load(); n != 3 {
+		t.Errorf("%d lookups done, want failures retried once they expire", n-1)
+	}
+}
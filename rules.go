@@ -0,0 +1,258 @@
+//
+// rules.go - Allowing, denying and routing connections by what clients send
+//
+// Copyright (C) 2013 Ryan A. Chapman. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+//      this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+//      this list of conditions and the following disclaimer in the documentation
+//      and/or other materials provided with the distribution.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHORS
+// OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+// The -rules file decides what happens to a connection, proxied or direct,
+// based on what was peeked from its client (see sniff.go). Each line is one
+// rule, a list of field=pattern conditions and then an action:
+//
+//   ja3=5a1edc7f170af1014fc65c994878e63c deny
+//   protocol=tls ja4=t13d3112h2_* proxy inspect.example.com:3128
+//   version=TLS1.[01] proxy inspect.example.com:3128
+//   ech=true deny
+//   alpn=acme-tls/1 allow
+//   protocol=ssh allow
+//
+// The fields are protocol, sni, ja3, ja4, alpn (any protocol the client
+// offers), version (the highest TLS version it offers, TLS1.0 to TLS1.3, as
+// SSL 3.0 ClientHellos aren't decoded) and ech (true or false). Patterns are
+// shell patterns (* and ?, where * doesn't match a /), and a rule applies if
+// every one of its conditions matches. The first rule that applies is used:
+// allow sends the connection on as usual, deny closes it and proxy sends it
+// through the named upstream proxy, which need not be one of -p, instead of
+// through -p or directly. Its credentials come from the rule
+// (user:password@host:port) or -credentials. Connections no rule applies to
+// are sent on as usual. Upstream proxies named by rules can be set up or down
+// through the admin API like those of -p.
+//
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	ruleAllow = "allow"
+	ruleDeny  = "deny"
+	ruleProxy = "proxy"
+)
+
+// ruleFields are what conditions can match on. A field can have no values,
+// such as ja3 for a client that doesn't speak TLS, and then never matches.
+var ruleFields = map[string]func(p *clientPeek) []string{
+	"protocol": func(p *clientPeek) []string {
+		return []string{p.protocol}
+	},
+	"sni": func(p *clientPeek) []string {
+		if p.hello == nil || p.hello.serverName == "" {
+			return nil
+		}
+		return []string{p.hello.serverName}
+	},
+	"ja3": func(p *clientPeek) []string {
+		if p.hello == nil {
+			return nil
+		}
+		return []string{p.hello.ja3()}
+	},
+	"ja4": func(p *clientPeek) []string {
+		if p.hello == nil {
+			return nil
+		}
+		return []string{p.hello.ja4()}
+	},
+	// any of the protocols offered
+	"alpn": func(p *clientPeek) []string {
+		if p.hello == nil {
+			return nil
+		}
+		return p.hello.alpn
+	},
+	// the highest version offered, as TLS1.0 to TLS1.3
+	"version": func(p *clientPeek) []string {
+		if p.hello == nil {
+			return nil
+		}
+		return []string{versionName(p.hello.maxVersion())}
+	},
+	"ech": func(p *clientPeek) []string {
+		if p.hello == nil {
+			return nil
+		}
+		return []string{strconv.FormatBool(p.hello.ech)}
+	},
+}
+
+type ruleCond struct {
+	field   string
+	pattern string
+}
+
+type rule struct {
+	line     int
+	text     string
+	conds    []ruleCond
+	action   string
+	upstream string // host:port, for ruleProxy
+	auth     string // base64 encoded credentials for upstream, or ""
+}
+
+func (r *rule) String() string {
+	return fmt.Sprintf("rule %d (%s)", r.line, r.text)
+}
+
+// matches reports whether every condition of r matches p.
+func (r *rule) matches(p *clientPeek) bool {
+	for _, c := range r.conds {
+		found := false
+		for _, v := range ruleFields[c.field](p) {
+			if ok, _ := path.Match(c.pattern, v); ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// matchRule returns the first of rules that applies to p, or nil if none does
+// or nothing was peeked.
+func matchRule(rules []*rule, p *clientPeek) *rule {
+	if p == nil {
+		return nil
+	}
+	for _, r := range rules {
+		if r.matches(p) {
+			return r
+		}
+	}
+	return nil
+}
+
+// loadRules reads the rules file at path, if there is one. creds are the
+// credentials from -credentials, for upstreams named without them.
+func loadRules(path string, creds map[string]string) ([]*rule, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rules []*rule
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseRule(line, creds)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		r.line = n
+		rules = append(rules, r)
+	}
+	return rules, sc.Err()
+}
+
+func parseRule(line string, creds map[string]string) (*rule, error) {
+	r := &rule{}
+	words := strings.Fields(line)
+	for len(words) > 0 && strings.Contains(words[0], "=") {
+		field, pattern, _ := strings.Cut(words[0], "=")
+		if ruleFields[field] == nil {
+			return nil, fmt.Errorf("unknown field %q", field)
+		}
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return nil, fmt.Errorf("invalid pattern %q for %s", pattern, field)
+		}
+		r.conds = append(r.conds, ruleCond{field, pattern})
+		words = words[1:]
+	}
+	if len(r.conds) == 0 {
+		return nil, fmt.Errorf("rule has no field=pattern conditions")
+	}
+	if len(words) == 0 {
+		return nil, fmt.Errorf("rule has no action")
+	}
+	r.action = words[0]
+	switch {
+	case (r.action == ruleAllow || r.action == ruleDeny) && len(words) == 1:
+	case r.action == ruleProxy && len(words) == 2:
+		u, err := parseUpstream(words[1])
+		if err != nil {
+			return nil, err
+		}
+		r.upstream = u.addr
+		r.auth = creds[u.addr]
+		if u.hasAuth {
+			r.auth = u.basicAuth()
+		}
+		words[1] = redactUpstream(words[1])
+	case r.action == ruleProxy:
+		return nil, fmt.Errorf("proxy needs one upstream proxy, as host:port")
+	default:
+		return nil, fmt.Errorf("unknown action %q, must be allow, deny or proxy HOST:PORT", strings.Join(words, " "))
+	}
+	r.text = strings.Join(append(conditionWords(r.conds), words...), " ")
+	return r, nil
+}
+
+func conditionWords(conds []ruleCond) []string {
+	var ret []string
+	for _, c := range conds {
+		ret = append(ret, c.field+"="+c.pattern)
+	}
+	return ret
+}
+
+// withRules returns a copy of c with rules, and with the credentials of the
+// upstreams they route to where the tunnel code looks for them.
+func (c *proxyConfig) withRules(rules []*rule) *proxyConfig {
+	n := *c
+	n.rules = rules
+	n.authProxyServers = make(map[string]string)
+	for _, r := range rules {
+		if r.auth != "" {
+			n.authProxyServers[r.upstream] = r.auth
+		}
+	}
+	// the credentials given with -p win
+	for spec, auth := range c.authProxyServers {
+		n.authProxyServers[spec] = auth
+	}
+	return &n
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLoadRules(t *testing.T) {
+	path := writeTestFile(t, "rules", `# rules
+ja3=5a1edc7f170af1014fc65c994878e63c deny
+
+protocol=tls sni=*.example.com proxy alice:s3cret@10.1.1.1:3128
+protocol=tls ja4=t13d3112h2_* proxy 10.2.2.2:8080
+protocol=ssh allow
+`)
+	creds := map[string]string{"10.2.2.2:8080": "Ym9iOnB3"}
+	rules, err := loadRules(path, creds)
+	if err != nil {
+		t.Fatalf("loadRules(): %v", err)
+	}
+	if len(rules) != 4 {
+		t.Fatalf("loadRules() found %d rules, want 4", len(rules))
+	}
+	if got := rules[1].String(); got != "rule 4 (protocol=tls sni=*.example.com proxy alice:xxxxx@10.1.1.1:3128)" {
+		t.Errorf("rule with a password shows as %s", got)
+	}
+	if rules[1].upstream != "10.1.1.1:3128" || rules[1].auth != "YWxpY2U6czNjcmV0" {
+		t.Errorf("rule 4 goes to %s with %q, want 10.1.1.1:3128 as alice", rules[1].upstream, rules[1].auth)
+	}
+	if rules[2].auth != "Ym9iOnB3" {
+		t.Errorf("rule 5 has credentials %q, want those from -credentials", rules[2].auth)
+	}
+
+	if rules, err := loadRules("", nil); rules != nil || err != nil {
+		t.Errorf("loadRules(\"\") = %v, %v, want no rules", rules, err)
+	}
+}
+
+func TestLoadRulesErrors(t *testing.T) {
+	for contents, want := range map[string]string{
+		"protocol=tls\n":                 ":1: rule has no action",
+		"deny\n":                         ":1: rule has no field=pattern conditions",
+		"\nport=443 deny\n":              `:2: unknown field "port"`,
+		"sni=[a deny\n":                  `:1: invalid pattern "[a" for sni`,
+		"sni= deny\n":                    `:1: invalid pattern "" for sni`,
+		"sni=a reject\n":                 `:1: unknown action "reject"`,
+		"sni=a allow now\n":              `:1: unknown action "allow now"`,
+		"sni=a proxy\n":                  ":1: proxy needs one upstream proxy",
+		"sni=a proxy u:pw@host:port:1\n": ":1: ",
+	} {
+		_, err := loadRules(writeTestFile(t, "rules", contents), nil)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("loadRules() of %q = %v, want an error with %q", contents, err, want)
+		}
+		if err != nil && strings.Contains(err.Error(), "pw") {
+			t.Errorf("loadRules() error shows the password: %v", err)
+		}
+	}
+	if _, err := loadRules(filepath.Join(t.TempDir(), "missing"), nil); err == nil {
+		t.Errorf("loadRules() of a missing file did not fail")
+	}
+}
+
+func TestMatchRule(t *testing.T) {
+	rules, err := loadRules(writeTestFile(t, "rules", `
+protocol=tls sni=blocked.example.com deny
+protocol=tls ja3=0149f47eabf9a20d0893e2a44e5a6323 proxy 10.3.3.3:3128
+protocol=tls allow
+ja3=* deny
+protocol=s* deny
+`), nil)
+	if err != nil {
+		t.Fatalf("loadRules(): %v", err)
+	}
+	curl := readFixture(t, "curl-7.88.bin")
+	blocked := *curl
+	blocked.serverName = "blocked.example.com"
+	tests := []struct {
+		peek *clientPeek
+		line int // 0 for no rule
+	}{
+		{&clientPeek{protocol: protoTLS, hello: &blocked}, 2},
+		{&clientPeek{protocol: protoTLS, hello: curl}, 3},
+		{&clientPeek{protocol: protoTLS, hello: readFixture(t, "openssl-3.0-tls13.bin")}, 4},
+		{&clientPeek{protocol: protoSSH}, 6},
+		{&clientPeek{protocol: protoServerFirst}, 6},
+		{&clientPeek{protocol: protoHTTP}, 0},
+		{nil, 0},
+	}
+	for i, tt := range tests {
+		r := matchRule(rules, tt.peek)
+		if tt.line == 0 && r != nil {
+			t.Errorf("peek %d matched %s, want none", i+1, r)
+		}
+		if tt.line != 0 && (r == nil || r.line != tt.line) {
+			t.Errorf("peek %d matched %v, want rule %d", i+1, r, tt.line)
+		}
+	}
+}
+
+func TestWithRules(t *testing.T) {
+	cfg, err := newProxyConfig([]string{"10.1.1.1:3128"}, map[string]string{"10.1.1.1:3128": "from-p"}, nil)
+	if err != nil {
+		t.Fatalf("newProxyConfig(): %v", err)
+	}
+	rules, err := loadRules(writeTestFile(t, "rules", `
+sni=a proxy ann:pw@10.1.1.1:3128
+sni=b proxy ben:pw@10.2.2.2:3128
+sni=c proxy 10.3.3.3:3128
+`), nil)
+	if err != nil {
+		t.Fatalf("loadRules(): %v", err)
+	}
+	n := cfg.withRules(rules)
+	if len(n.rules) != 3 || cfg.rules != nil {
+		t.Errorf("withRules() set %d rules on the copy and %d on the original", len(n.rules), len(cfg.rules))
+	}
+	want := map[string]string{"10.1.1.1:3128": "from-p", "10.2.2.2:3128": "YmVuOnB3"}
+	if len(n.authProxyServers) != len(want) {
+		t.Errorf("withRules() credentials %v, want %v", n.authProxyServers, want)
+	}
+	for spec, auth := range want {
+		if n.authProxyServers[spec] != auth {
+			t.Errorf("withRules() credentials for %s = %q, want %q", spec, n.authProxyServers[spec], auth)
+		}
+	}
+	if len(cfg.authProxyServers) != 1 {
+		t.Errorf("withRules() changed the original credentials: %v", cfg.authProxyServers)
+	}
+}
+
+func TestMatchRuleALPNVersionECH(t *testing.T) {
+	rules, err := loadRules(writeTestFile(t, "rules", `
+ech=true deny
+version=TLS1.[01] proxy 10.4.4.4:3128
+alpn=acme-tls/* allow
+alpn=h2 version=TLS1.3 proxy 10.5.5.5:3128
+ech=false deny
+`), nil)
+	if err != nil {
+		t.Fatalf("loadRules(): %v", err)
+	}
+	hello := func(rec []byte) *clientHello {
+		h, err := readClientHello(bytes.NewReader(rec))
+		if err != nil {
+			t.Fatalf("readClientHello(): %v", err)
+		}
+		return h
+	}
+	tls10 := buildClientHello([]uint16{0x002f})
+	tls10[9], tls10[10] = 3, 1
+	tests := []struct {
+		what  string
+		hello *clientHello
+		line  int // 0 for no rule
+	}{
+		{"ECH", hello(buildClientHello([]uint16{0x1301}, ext(extSupportedVersions, 2, 3, 4), ext(extECH, 0))), 2},
+		{"TLS 1.0", hello(tls10), 3},
+		{"ACME", hello(buildClientHello([]uint16{0x1301}, ext(extALPN, 0, 11, 10, 'a', 'c', 'm', 'e', '-', 't', 'l', 's', '/', '1'))), 4},
+		{"h2 and TLS 1.3", readFixture(t, "openssl-3.0-tls13.bin"), 5},
+		{"TLS 1.2 without ALPN", readFixture(t, "openssl-3.0-tls12-nosni.bin"), 6},
+		{"not TLS", nil, 0},
+	}
+	for _, tt := range tests {
+		p := &clientPeek{protocol: protoTLS, hello: tt.hello}
+		if tt.hello == nil {
+			p.protocol = protoSSH
+		}
+		r := matchRule(rules, p)
+		if tt.line == 0 && r != nil {
+			t.Errorf("%s matched %s, want none", tt.what, r)
+		}
+		if tt.line != 0 && (r == nil || r.line != tt.line) {
+			t.Errorf("%s matched %v, want rule %d", tt.what, r, tt.line)
+		}
+	}
+}
+
+// transparentPair returns the two ends of a connection accepted on a
+// transparent socket, as if redirected by TPROXY, so that its original
+// destination is the listener's own address.
+func transparentPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	rc, _ := l.SyscallConn()
+	var serr error
+	rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, IP_TRANSPARENT, 1)
+	})
+	if serr != nil {
+		t.Skipf("can't make a transparent socket: %v", serr)
+	}
+	client, err := net.DialTCP("tcp4", nil, l.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	c, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatalf("could not accept: %v", err)
+	}
+	t.Cleanup(func() { client.Close(); c.Close() })
+	return client, c
+}
+
+func TestHandleConnectionRulesOnDirects(t *testing.T) {
+	upstream, reqs := fakeHTTPProxy(t, "HTTP/1.1 200 Connection established\r\n\r\n")
+	rules, err := loadRules(writeTestFile(t, "rules", `
+sni=www.example.com deny
+sni=www.example.org proxy `+upstream+`
+`), nil)
+	if err != nil {
+		t.Fatalf("loadRules(): %v", err)
+	}
+	// everything to 127.0.0.1 goes direct, the only proxy is never tried
+	cfg, err := newProxyConfig([]string{"127.0.0.1:1"}, nil, []string{"127.0.0.1"})
+	if err != nil {
+		t.Fatalf("newProxyConfig(): %v", err)
+	}
+	orig := currentConfig()
+	setConfig(cfg.withRules(rules))
+	defer setConfig(orig)
+	hello := func(name string) []byte {
+		b, err := os.ReadFile(filepath.Join("testdata", "clienthello", name))
+		if err != nil {
+			t.Fatalf("could not read fixture: %v", err)
+		}
+		return b
+	}
+
+	// handle runs handleConnection for the client of a new connection until
+	// the test is done with it, so that no tunnel outlives the test
+	handle := func() *net.TCPConn {
+		client, c := transparentPair(t)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		done := make(chan bool)
+		go func() {
+			handleConnection(c)
+			close(done)
+		}()
+		t.Cleanup(func() {
+			client.Close()
+			<-done
+		})
+		return client
+	}
+
+	client := handle()
+	client.Write(hello("openssl-3.0-tls13.bin"))
+	if n, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("denied direct connection read %d bytes, %v, want it closed", n, err)
+	}
+
+	client = handle()
+	client.Write(hello("curl-7.88.bin"))
+	req := <-reqs
+	if req == nil {
+		t.Fatalf("direct connection was not sent to the upstream of its rule")
+	}
+	if want := client.RemoteAddr().String(); req.Method != "CONNECT" || req.RequestURI != want {
+		t.Errorf("upstream got %s %s, want CONNECT %s", req.Method, req.RequestURI, want)
+	}
+}
@@ -0,0 +1,119 @@
+//
+// shutdown.go - Graceful shutdown, draining open tunnels before exiting
+//
+// Copyright (C) 2013 Ryan A. Chapman. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+//      this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+//      this list of conditions and the following disclaimer in the documentation
+//      and/or other materials provided with the distribution.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHORS
+// OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/zdannar/flogger"
+)
+
+const defaultDrainTimeout = 30 * time.Second
+
+// closed when shutdown begins
+var gShuttingDown = make(chan bool)
+var gShutdownOnce sync.Once
+
+func shuttingDown() bool {
+	select {
+	case <-gShuttingDown:
+		return true
+	default:
+		return false
+	}
+}
+
+func setupShutdown(listener net.Listener) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-c
+		log.Infof("Received %v, shutting down", sig)
+		shutdown(listener, gDrainTimeout)
+		os.Exit(0)
+	}()
+}
+
+// shutdown stops accepting new connections, admin requests and DNS queries,
+// waits up to timeout for the open tunnels to finish, closes whatever is left
+// and writes out the final stats.
+// If a shutdown is already in progress, it waits for that one to finish.
+func shutdown(listener net.Listener, timeout time.Duration) {
+	gShutdownOnce.Do(func() {
+		close(gShuttingDown)
+		listener.Close()
+		// after an upgrade the new process has these too, and has to be
+		// the only one answering on them
+		if ul, ok := gAdminListener.(*net.UnixListener); ok {
+			// the socket file is the new process's now
+			ul.SetUnlinkOnClose(false)
+		}
+		for _, c := range []io.Closer{gAdminListener, gDNSListener, gDNSConn} {
+			if c != nil {
+				c.Close()
+			}
+		}
+		sdNotifyf("STOPPING=1\nSTATUS=Draining %d tunnels", numActiveTunnels())
+
+		drained, killed := drainTunnels(timeout)
+		log.Infof("Shutdown: %d tunnels finished while draining, %d killed after the %v drain timeout", drained, killed, timeout)
+
+		stopProfiling()
+		saveReverseLookups()
+		writeStats()
+		flushLogs(time.Second)
+	})
+}
+
+// drainTunnels waits up to timeout for the open tunnels to finish on their own,
+// then closes the rest.
+func drainTunnels(timeout time.Duration) (drained, killed uint64) {
+	finished := numFinishedTunnels()
+	if n := numActiveTunnels(); n > 0 {
+		log.Infof("Shutdown: waiting up to %v for %d open tunnels to finish", timeout, n)
+	}
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if numActiveTunnels() == 0 {
+			break
+		}
+	}
+	for _, t := range activeTunnels() {
+		log.Debugf("Shutdown: killing tunnel %v", t)
+		t.close()
+		untrackTunnel(t)
+		killed++
+	}
+	drained = numFinishedTunnels() - finished - killed
+	return
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDrainTunnels(t *testing.T) {
+	// a tunnel whose client goes away while we drain
+	c1, c2 := net.Pipe()
+	s1, s2 := net.Pipe()
+	done := trackTunnel(c1, s1, "1.2.3.4:80", viaDirect)
+	go relayTunnel(done, "directserver")
+	defer s2.Close()
+
+	// and one that stays open until it is killed
+	c3, c4 := net.Pipe()
+	s3, s4 := net.Pipe()
+	defer c4.Close()
+	defer s4.Close()
+	idle := trackTunnel(c3, s3, "2.3.4.5:22", viaDirect)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		c2.Close()
+	}()
+	drained, killed := drainTunnels(500 * time.Millisecond)
+	if drained != 1 || killed != 1 {
+		t.Errorf("drainTunnels() = %d drained, %d killed, want 1 drained, 1 killed", drained, killed)
+	}
+	if n := numActiveTunnels(); n != 0 {
+		t.Errorf("%d tunnels still open after drainTunnels()", n)
+	}
+	if _, err := c4.Write([]byte("x")); err == nil {
+		t.Errorf("tunnel %v was not closed after the drain timeout", idle)
+	}
+}
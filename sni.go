@@ -19,29 +19,121 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
 )
 
-func extractSNI(r io.Reader) (string, int, error) {
-	handshake, tlsver, err := handshakeRecord(r)
-	if err != nil {
-		return "", 0, fmt.Errorf("reading TLS record: %s", err)
+// A clientHello is what a TLS ClientHello says about the connection a client
+// wants. Values are as sent, GREASE included, so that they can be logged and
+// matched on as they are.
+type clientHello struct {
+	recordVersion       int // minor version of the first record, 1 is TLS 1.0
+	version             uint16
+	serverName          string
+	alpn                []string
+	versions            []uint16 // supported_versions
+	cipherSuites        []uint16
+	extensions          []uint16 // in the order they were sent
+	supportedGroups     []uint16
+	keyShareGroups      []uint16
+	pointFormats        []uint8
+	signatureAlgorithms []uint16
+	ech                 bool // has an encrypted_client_hello extension
+	grease              bool // has a GREASE value anywhere
+}
+
+const (
+	extServerName          = 0
+	extSupportedGroups     = 10
+	extECPointFormats      = 11
+	extSignatureAlgorithms = 13
+	extALPN                = 16
+	extSupportedVersions   = 43
+	extKeyShare            = 51
+	extECH                 = 0xfe0d
+)
+
+// isGREASE reports whether v is one of the values clients put in lists to
+// keep servers from choking on ones they don't know (RFC 8701).
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// versionName names a TLS version for the logs.
+func versionName(v uint16) string {
+	switch v {
+	case 0x0300:
+		return "SSL3.0"
+	case 0x0301:
+		return "TLS1.0"
+	case 0x0302:
+		return "TLS1.1"
+	case 0x0303:
+		return "TLS1.2"
+	case 0x0304:
+		return "TLS1.3"
+	}
+	if isGREASE(v) {
+		return "GREASE"
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+// offeredVersions returns the TLS versions the client offers, from
+// supported_versions if it sent that and otherwise the ClientHello version,
+// leaving out GREASE.
+func (h *clientHello) offeredVersions() []uint16 {
+	if len(h.versions) == 0 {
+		return []uint16{h.version}
+	}
+	var ret []uint16
+	for _, v := range h.versions {
+		if !isGREASE(v) {
+			ret = append(ret, v)
+		}
 	}
+	return ret
+}
 
-	sni, err := parseHello(handshake)
-	if err != nil {
-		return "", 0, fmt.Errorf("reading ClientHello: %s", err)
+// maxVersion returns the highest TLS version the client offers.
+func (h *clientHello) maxVersion() uint16 {
+	var max uint16
+	for _, v := range h.offeredVersions() {
+		if v > max {
+			max = v
+		}
 	}
-	if len(sni) == 0 {
-		// ClientHello did not present an SNI extension. Valid packet,
-		// no hostname.
-		return "", tlsver, nil
+	return max
+}
+
+func (h *clientHello) String() string {
+	var versions []string
+	for _, v := range h.offeredVersions() {
+		versions = append(versions, versionName(v))
+	}
+	// ALPN protocols are arbitrary bytes, quoted so they can't forge log lines
+	alpn := make([]string, len(h.alpn))
+	for i, p := range h.alpn {
+		alpn[i] = strconv.Quote(p)
+	}
+	return fmt.Sprintf("sni=%q alpn=%s versions=%s ciphers=%d extensions=%d ech=%v grease=%v",
+		h.serverName, strings.Join(alpn, ","), strings.Join(versions, ","), len(h.cipherSuites), len(h.extensions), h.ech, h.grease)
+}
+
+// readClientHello reads the TLS records holding the ClientHello from r and
+// decodes it.
+func readClientHello(r io.Reader) (*clientHello, error) {
+	handshake, tlsver, err := readHandshake(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading TLS record: %s", err)
 	}
 
-	hostname, err := parseSNI(sni)
+	hello, err := parseHello(handshake)
 	if err != nil {
-		return "", 0, fmt.Errorf("parsing SNI extension: %s", err)
+		return nil, fmt.Errorf("reading ClientHello: %s", err)
 	}
-	return hostname, tlsver, nil
+	hello.recordVersion = tlsver
+	return hello, nil
 }
 
 // Extract the indicated hostname, if any, from the given SNI
@@ -73,12 +165,10 @@ func parseSNI(b []byte) (string, error) {
 	return "", nil
 }
 
-const sniExtensionID = 0
 const sniHostnameID = 0
 
-// Parse a TLS handshake record as a ClientHello message and extract
-// the SNI extension bytes, if any.
-func parseHello(b []byte) ([]byte, error) {
+// Parse a TLS handshake message as a ClientHello.
+func parseHello(b []byte) (*clientHello, error) {
 	if len(b) == 0 {
 		return nil, errors.New("zero length handshake record")
 	}
@@ -110,14 +200,15 @@ func parseHello(b []byte) ([]byte, error) {
 	default:
 		return nil, fmt.Errorf("TLS record has unsupported version %d.%d", b[0], b[1])
 	}
+	hello := &clientHello{version: binary.BigEndian.Uint16(b)}
 
 	// Skip over version and random struct
 	b = b[34:]
 
-	// We don't technically care about SessionID, but we care that the
-	// framing is well-formed all the way up to the SNI field, so that
-	// we are sure that we're pulling the same SNI bytes as the
-	// eventual TLS implementation.
+	// We don't care about SessionID, but we care that the framing is
+	// well-formed all the way through the extensions, so that we are
+	// sure that we're reading the same values as the eventual TLS
+	// implementation.
 	vec, b, err := vector(b, 1)
 	if err != nil {
 		return nil, fmt.Errorf("reading ClientHello SessionID: %s", err)
@@ -126,7 +217,6 @@ func parseHello(b []byte) ([]byte, error) {
 		return nil, fmt.Errorf("ClientHello SessionID too long (%db)", len(vec))
 	}
 
-	// Likewise, we're just checking the bare minimum of framing.
 	vec, b, err = vector(b, 2)
 	if err != nil {
 		return nil, fmt.Errorf("reading ClientHello CipherSuites: %s", err)
@@ -134,6 +224,7 @@ func parseHello(b []byte) ([]byte, error) {
 	if len(vec) < 2 || len(vec)%2 != 0 {
 		return nil, fmt.Errorf("ClientHello CipherSuites invalid length %d", len(vec))
 	}
+	hello.cipherSuites = uint16s(vec)
 
 	vec, b, err = vector(b, 1)
 	if err != nil {
@@ -146,8 +237,8 @@ func parseHello(b []byte) ([]byte, error) {
 	// Finally, we reach the extensions.
 	if len(b) == 0 {
 		// No extensions. This is not an error, it just means we have
-		// no SNI payload.
-		return nil, nil
+		// nothing more to say about the connection.
+		return hello, nil
 	}
 	b, vec, err = vector(b, 2)
 	if err != nil {
@@ -163,10 +254,9 @@ func parseHello(b []byte) ([]byte, error) {
 		if err != nil {
 			return nil, fmt.Errorf("reading ClientHello extension %d: %s", typ, err)
 		}
-		if typ == sniExtensionID {
-			// Found the SNI extension, return its payload. We don't
-			// care about anything in the packet beyond this point.
-			return vec, nil
+		hello.extensions = append(hello.extensions, typ)
+		if err := hello.parseExtension(typ, vec); err != nil {
+			return nil, fmt.Errorf("reading ClientHello extension %d: %s", typ, err)
 		}
 	}
 
@@ -174,12 +264,120 @@ func parseHello(b []byte) ([]byte, error) {
 		return nil, fmt.Errorf("%d bytes of trailing garbage in ClientHello", len(b))
 	}
 
-	// Successfully parsed all extensions, but there was no SNI.
-	return nil, nil
+	for _, list := range [][]uint16{hello.cipherSuites, hello.extensions, hello.versions, hello.supportedGroups, hello.keyShareGroups} {
+		for _, v := range list {
+			hello.grease = hello.grease || isGREASE(v)
+		}
+	}
+	return hello, nil
+}
+
+// parseExtension records what the ClientHello extension typ, with payload b,
+// says. Extensions that aren't of interest are skipped.
+func (h *clientHello) parseExtension(typ uint16, b []byte) error {
+	var err error
+	switch typ {
+	case extServerName:
+		h.serverName, err = parseSNI(b)
+	case extALPN:
+		var list []byte
+		if list, _, err = vector(b, 2); err != nil {
+			return err
+		}
+		for len(list) > 0 {
+			var proto []byte
+			if proto, list, err = vector(list, 1); err != nil {
+				return err
+			}
+			h.alpn = append(h.alpn, string(proto))
+		}
+	case extSupportedVersions:
+		h.versions, err = uint16Vector(b, 1)
+	case extSupportedGroups:
+		h.supportedGroups, err = uint16Vector(b, 2)
+	case extSignatureAlgorithms:
+		h.signatureAlgorithms, err = uint16Vector(b, 2)
+	case extECPointFormats:
+		var formats []byte
+		formats, _, err = vector(b, 1)
+		h.pointFormats = append([]uint8(nil), formats...)
+	case extKeyShare:
+		var shares []byte
+		if shares, _, err = vector(b, 2); err != nil {
+			return err
+		}
+		for len(shares) >= 2 {
+			h.keyShareGroups = append(h.keyShareGroups, binary.BigEndian.Uint16(shares))
+			if _, shares, err = vector(shares[2:], 2); err != nil {
+				return err
+			}
+		}
+		if len(shares) != 0 {
+			return errors.New("truncated key share")
+		}
+	case extECH:
+		h.ech = true
+	}
+	return err
+}
+
+// uint16Vector reads a vector of 16 bit values with a lenBytes long length.
+func uint16Vector(b []byte, lenBytes int) ([]uint16, error) {
+	vec, _, err := vector(b, lenBytes)
+	if err != nil {
+		return nil, err
+	}
+	if len(vec)%2 != 0 {
+		return nil, fmt.Errorf("odd length %d for a list of 16 bit values", len(vec))
+	}
+	return uint16s(vec), nil
+}
+
+func uint16s(b []byte) []uint16 {
+	ret := make([]uint16, 0, len(b)/2)
+	for ; len(b) >= 2; b = b[2:] {
+		ret = append(ret, binary.BigEndian.Uint16(b))
+	}
+	return ret
 }
 
 const maxTLSRecordLength = 16384
 
+// Largest ClientHello that is put back together from several records.
+// Post-quantum key shares make them a couple of KB, but nowhere near this.
+// Connections only get as far as sniffMaxBytes (sniff.go), since that is all
+// peekClient peeks, so for them that is the real limit.
+const maxHandshakeLength = 65536
+
+// Read TLS records from r until they hold a whole handshake message, which
+// can be split across several of them, and return it along with the minor
+// version of the first record.
+func readHandshake(r io.Reader) ([]byte, int, error) {
+	msg, tlsver, err := handshakeRecord(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	for {
+		if len(msg) >= 4 {
+			n := 4 + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]))
+			if n > maxHandshakeLength {
+				return nil, 0, fmt.Errorf("handshake message length is greater than %d", maxHandshakeLength)
+			}
+			if len(msg) >= n {
+				return msg[:n], tlsver, nil
+			}
+		}
+		more, _, err := handshakeRecord(r)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(more) == 0 {
+			return nil, 0, errors.New("empty TLS handshake record")
+		}
+		msg = append(msg, more...)
+	}
+}
+
 // Read one TLS record, which must be for the handshake protocol, from r.
 func handshakeRecord(r io.Reader) ([]byte, int, error) {
 	var hdr struct {
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// captureClientHello returns the TLS records crypto/tls sends to start a
+// handshake with config.
+func captureClientHello(t *testing.T, config *tls.Config) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, config).Handshake()
+		client.Close()
+	}()
+	var hdr [5]byte
+	if _, err := io.ReadFull(server, hdr[:]); err != nil {
+		t.Fatalf("no ClientHello: %v", err)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[3:]))
+	if _, err := io.ReadFull(server, body); err != nil {
+		t.Fatalf("short ClientHello: %v", err)
+	}
+	return append(hdr[:], body...)
+}
+
+// fragment splits the handshake message in the single TLS record rec into
+// records of at most size bytes each.
+func fragment(rec []byte, size int) []byte {
+	var ret []byte
+	for msg := rec[5:]; len(msg) > 0; {
+		n := size
+		if n > len(msg) {
+			n = len(msg)
+		}
+		ret = append(ret, rec[0], rec[1], rec[2])
+		ret = binary.BigEndian.AppendUint16(ret, uint16(n))
+		ret = append(ret, msg[:n]...)
+		msg = msg[n:]
+	}
+	return ret
+}
+
+func TestReadClientHello(t *testing.T) {
+	rec := captureClientHello(t, &tls.Config{
+		ServerName: "secure.example.com",
+		NextProtos: []string{"h2", "http/1.1"},
+		MinVersion: tls.VersionTLS12,
+	})
+	whole, err := readClientHello(bytes.NewReader(rec))
+	if err != nil {
+		t.Fatalf("readClientHello(): %v", err)
+	}
+	if whole.serverName != "secure.example.com" || !reflect.DeepEqual(whole.alpn, []string{"h2", "http/1.1"}) {
+		t.Errorf("sni %q, alpn %q, want secure.example.com and h2,http/1.1", whole.serverName, whole.alpn)
+	}
+	if !reflect.DeepEqual(whole.offeredVersions(), []uint16{tls.VersionTLS13, tls.VersionTLS12}) {
+		t.Errorf("offered versions %x, want TLS 1.3 and 1.2", whole.offeredVersions())
+	}
+	if len(whole.cipherSuites) == 0 || len(whole.keyShareGroups) == 0 || len(whole.supportedGroups) == 0 || len(whole.signatureAlgorithms) == 0 {
+		t.Errorf("ciphers, key shares, groups or signature algorithms missing: %+v", whole)
+	}
+	if whole.ech || whole.grease {
+		t.Errorf("crypto/tls sent neither ECH nor GREASE, got ech=%v grease=%v", whole.ech, whole.grease)
+	}
+
+	// split across records, even in the middle of the handshake header
+	for _, size := range []int{2, 100} {
+		r := bytes.NewReader(append(fragment(rec, size), "rest"...))
+		got, err := readClientHello(r)
+		if err != nil {
+			t.Fatalf("readClientHello() of %d byte fragments: %v", size, err)
+		}
+		if !reflect.DeepEqual(got, whole) {
+			t.Errorf("readClientHello() of %d byte fragments = %+v, want %+v", size, got, whole)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != "rest" {
+			t.Errorf("readClientHello() of %d byte fragments read past the ClientHello, left %q", size, rest)
+		}
+	}
+
+	bad := map[string][]byte{
+		"truncated":   fragment(rec, 100)[:300],
+		"not a hello": {22, 3, 1, 0, 4, 2, 0, 0, 0},
+		"alert":       {21, 3, 1, 0, 2, 2, 40},
+		"empty":       append([]byte{22, 3, 1, 0, 2, 1, 0}, 22, 3, 1, 0, 0),
+	}
+	for what, b := range bad {
+		if _, err := readClientHello(bytes.NewReader(b)); err == nil {
+			t.Errorf("readClientHello() of %s did not fail", what)
+		}
+	}
+}
+
+// buildClientHello puts together a ClientHello record with the given cipher
+// suites and extensions.
+func buildClientHello(ciphers []uint16, exts ...[]byte) []byte {
+	body := []byte{3, 3}
+	body = append(body, make([]byte, 32)...)
+	body = append(body, 0)
+	body = binary.BigEndian.AppendUint16(body, uint16(2*len(ciphers)))
+	for _, c := range ciphers {
+		body = binary.BigEndian.AppendUint16(body, c)
+	}
+	body = append(body, 1, 0)
+	all := bytes.Join(exts, nil)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(all)))
+	body = append(body, all...)
+
+	msg := []byte{1, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	msg = append(msg, body...)
+	rec := []byte{22, 3, 1}
+	rec = binary.BigEndian.AppendUint16(rec, uint16(len(msg)))
+	return append(rec, msg...)
+}
+
+func ext(typ uint16, payload ...byte) []byte {
+	b := binary.BigEndian.AppendUint16(nil, typ)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	return append(b, payload...)
+}
+
+func TestReadClientHelloGREASEAndECH(t *testing.T) {
+	rec := buildClientHello([]uint16{0x2a2a, 0x1301},
+		ext(0x3a3a),
+		ext(extSupportedVersions, 4, 0x4a, 0x4a, 3, 4),
+		ext(extKeyShare, 0, 9, 0x5a, 0x5a, 0, 1, 0, 0, 0x1d, 0, 0),
+		ext(extECH, 0),
+	)
+	h, err := readClientHello(bytes.NewReader(rec))
+	if err != nil {
+		t.Fatalf("readClientHello(): %v", err)
+	}
+	if !h.grease || !h.ech {
+		t.Errorf("grease=%v ech=%v, want both", h.grease, h.ech)
+	}
+	if !reflect.DeepEqual(h.extensions, []uint16{0x3a3a, extSupportedVersions, extKeyShare, extECH}) {
+		t.Errorf("extensions %x", h.extensions)
+	}
+	if !reflect.DeepEqual(h.offeredVersions(), []uint16{tls.VersionTLS13}) {
+		t.Errorf("offered versions %x, want TLS 1.3 without GREASE", h.offeredVersions())
+	}
+	if !reflect.DeepEqual(h.keyShareGroups, []uint16{0x5a5a, 0x1d}) {
+		t.Errorf("key share groups %x", h.keyShareGroups)
+	}
+	if h.serverName != "" {
+		t.Errorf("found SNI %q in a ClientHello without one", h.serverName)
+	}
+
+	evil := buildClientHello([]uint16{0x1301}, ext(extALPN, 0, 6, 5, 'h', '2', '\n', 'X', '"'))
+	if h, err = readClientHello(bytes.NewReader(evil)); err != nil {
+		t.Fatalf("readClientHello(): %v", err)
+	}
+	if got := h.String(); !strings.Contains(got, `alpn="h2\nX\"" `) {
+		t.Errorf("String() = %s, want the ALPN protocol quoted", got)
+	}
+
+	broken := buildClientHello([]uint16{0x1301}, ext(extKeyShare, 0, 5, 0, 0x1d, 0, 4, 0))
+	if _, err := readClientHello(bytes.NewReader(broken)); err == nil {
+		t.Errorf("readClientHello() of a truncated key share did not fail")
+	}
+}
@@ -0,0 +1,200 @@
+//
+// sniff.go - Finding the hostname a client wants in the first bytes it sends
+//
+// Copyright (C) 2013 Ryan A. Chapman. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+//      this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+//      this list of conditions and the following disclaimer in the documentation
+//      and/or other materials provided with the distribution.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHORS
+// OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+// Before a proxied connection is sent upstream, the first bytes the client
+// sends can be read to find out what protocol it speaks (TLS, HTTP/1.x, the
+// HTTP/2 preface, SSH) and the hostname it wants: the SNI of a TLS ClientHello
+// (-S) or the Host header of a plaintext HTTP request (-hostsniff). That name
+// then goes in the CONNECT request instead of the destination IP. Only the
+// sniffer for the protocol found is run, so -S=1 doesn't try to make a
+// ClientHello out of an SSH banner.
+//
+// A client that sends nothing within -peektimeout is taken to be waiting for
+// the server to speak first (SMTP, FTP, ...) and is sent upstream straight
+// away. Otherwise, reading stops after sniffMaxBytes or sniffTimeout. Whatever
+// was read is held on to and sent exactly once, to the upstream proxy that
+// accepted the CONNECT, ahead of the rest of the connection.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	// how long to wait for the client to send enough to find a hostname
+	sniffTimeout = 5 * time.Second
+	// most that is read looking for a hostname, which is plenty for a
+	// ClientHello or the headers of a request
+	sniffMaxBytes = 16 * 1024
+
+	// how long to wait for the client to speak first
+	defaultPeekTimeout = 300 * time.Millisecond
+
+	tlsRecordTypeHandshake = 0x16
+
+	http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+)
+
+// Protocols a client can be found to speak.
+const (
+	protoTLS         = "tls"
+	protoHTTP        = "http"
+	protoHTTP2       = "h2"
+	protoSSH         = "ssh"
+	protoServerFirst = "server-first" // nothing sent within -peektimeout
+	protoUnknown     = "unknown"
+)
+
+// protocols lists them in the order they are shown in the stats.
+var protocols = []string{protoTLS, protoHTTP, protoHTTP2, protoSSH, protoServerFirst, protoUnknown}
+
+// A clientPeek is what was learnt from the first bytes a client sent.
+type clientPeek struct {
+	protocol string
+	hostname string       // "" if none was found
+	source   string       // what hostname was found in, "SNI" or "Host"
+	hello    *clientHello // the TLS ClientHello, if it was read
+	peeked   []byte       // what was read, to be sent on before anything else
+}
+
+// peekClient waits up to wait for conn to start sending and works out what
+// protocol it speaks. A TLS ClientHello is decoded, and its SNI used as the
+// hostname if sni is set. The Host of an HTTP request is used if httpHost is
+// set.
+func peekClient(conn net.Conn, wait time.Duration, sni, httpHost bool) *clientPeek {
+	var buf bytes.Buffer
+	p := &clientPeek{}
+	defer func() {
+		p.peeked = buf.Bytes()
+		incrProtocolConnections(p.protocol)
+	}()
+	conn.SetReadDeadline(time.Now().Add(wait))
+	defer conn.SetReadDeadline(time.Time{})
+	br := bufio.NewReaderSize(io.TeeReader(io.LimitReader(conn, sniffMaxBytes), &buf), sniffMaxBytes)
+
+	if _, err := br.Peek(1); err != nil {
+		p.protocol = protoUnknown
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			p.protocol = protoServerFirst
+		}
+		return p
+	}
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	// whatever came with the first read is enough to tell them apart
+	first, _ := br.Peek(br.Buffered())
+	p.protocol = classifyProtocol(first)
+	switch {
+	case p.protocol == protoTLS:
+		// read even without -S, for the fingerprints
+		if hello, err := readClientHello(br); err == nil {
+			p.hello = hello
+			if sni {
+				p.hostname = hello.serverName
+			}
+		}
+		p.source = "SNI"
+	case p.protocol == protoHTTP && httpHost:
+		p.hostname, _ = extractHTTPHost(br)
+		p.source = "Host"
+	}
+	if p.hostname != "" && checkHostname(p.hostname) != nil {
+		// not something to put in a CONNECT request
+		p.hostname = ""
+	}
+	return p
+}
+
+// classifyProtocol says what protocol a connection that starts with b speaks.
+// b may be short, as long as it is not empty.
+func classifyProtocol(b []byte) string {
+	switch {
+	case b[0] == tlsRecordTypeHandshake && (len(b) < 2 || b[1] == 3):
+		return protoTLS
+	case hasPrefixSoFar(b, http2Preface):
+		// checked before HTTP/1.x, which "PRI " would pass for
+		return protoHTTP2
+	case hasPrefixSoFar(b, "SSH-"):
+		return protoSSH
+	case isHTTPRequestStart(b):
+		return protoHTTP
+	}
+	return protoUnknown
+}
+
+// hasPrefixSoFar reports whether b starts with prefix, or as much of it as b
+// is long.
+func hasPrefixSoFar(b []byte, prefix string) bool {
+	if len(b) > len(prefix) {
+		b = b[:len(prefix)]
+	}
+	return string(b) == prefix[:len(b)]
+}
+
+// maxHTTPMethodLen is longer than any method in use, with room to spare.
+const maxHTTPMethodLen = 20
+
+// isHTTPRequestStart reports whether b could be the start of an HTTP/1.x
+// request line: a method in upper case letters and then a space.
+func isHTTPRequestStart(b []byte) bool {
+	for i, c := range b {
+		switch {
+		case c == ' ':
+			return i > 0
+		case c < 'A' || c > 'Z' || i == maxHTTPMethodLen:
+			return false
+		}
+	}
+	return true
+}
+
+// extractHTTPHost reads the request line and headers of an HTTP request from
+// r and returns the host it is for, without the port.
+func extractHTTPHost(r *bufio.Reader) (string, error) {
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return "", err
+	}
+	if req.Method == http.MethodConnect {
+		return "", errors.New("CONNECT request")
+	}
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "" {
+		return "", errors.New("request has no Host")
+	}
+	return host, nil
+}
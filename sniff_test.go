@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSniffHTTPHost(t *testing.T) {
+	req := "GET /index.html HTTP/1.1\r\nHost: www.example.com:8080\r\nUser-Agent: test\r\n\r\nbody"
+	tests := []struct {
+		name, req, want string
+		httpHost        bool
+	}{
+		{"host", req, "www.example.com", true},
+		{"disabled", req, "", false},
+		{"absolute form", "GET http://abs.example.com/ HTTP/1.1\r\nHost: other.example.com\r\n\r\n", "abs.example.com", true},
+		{"IPv6 literal", "GET / HTTP/1.1\r\nHost: [2001:db8::1]:80\r\n\r\n", "", true},
+		{"no host", "GET / HTTP/1.0\r\n\r\n", "", true},
+		{"not HTTP", "SSH-2.0-OpenSSH_9.6\r\n", "", true},
+		{"binary", "\x00\x01\x02\x03", "", true},
+	}
+	for _, tt := range tests {
+		client, server := tcpPair(t)
+		client.Write([]byte(tt.req))
+		p := peekClient(server, time.Second, true, tt.httpHost)
+		if p.hostname != tt.want {
+			t.Errorf("%s: peekClient() found %q, want %q", tt.name, p.hostname, tt.want)
+		}
+		// nothing read is lost, and nothing is read twice
+		client.Write([]byte("more"))
+		client.CloseWrite()
+		rest, _ := io.ReadAll(server)
+		if all := string(p.peeked) + string(rest); all != tt.req+"more" {
+			t.Errorf("%s: client sent %q, peeked and read back %q", tt.name, tt.req+"more", all)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestClassifyProtocol(t *testing.T) {
+	tests := []struct {
+		start, want string
+	}{
+		{"\x16\x03\x01\x02\x00\x01", protoTLS},
+		{"\x16", protoTLS},
+		{"\x16\x00", protoUnknown},
+		{"GET / HTTP/1.1\r\n", protoHTTP},
+		{"OPTIONS * HTTP/1.1\r\n", protoHTTP},
+		{"GE", protoHTTP},
+		{"Get / HTTP/1.1\r\n", protoUnknown},
+		{" GET", protoUnknown},
+		{"ABCDEFGHIJKLMNOPQRSTUVWXYZ / HTTP/1.1", protoUnknown},
+		{http2Preface, protoHTTP2},
+		{"PRI * HTTP/2", protoHTTP2},
+		{"SSH-2.0-OpenSSH_9.6\r\n", protoSSH},
+		{"SSH-", protoSSH},
+		{"\x00\x00\x00\x01", protoUnknown},
+	}
+	for _, tt := range tests {
+		if got := classifyProtocol([]byte(tt.start)); got != tt.want {
+			t.Errorf("classifyProtocol(%q) = %s, want %s", tt.start, got, tt.want)
+		}
+	}
+}
+
+func TestPeekServerFirst(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+	start := time.Now()
+	p := peekClient(server, 50*time.Millisecond, true, true)
+	if p.protocol != protoServerFirst || len(p.peeked) != 0 {
+		t.Errorf("peekClient() of a silent client = %s, %q, want %s", p.protocol, p.peeked, protoServerFirst)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("peekClient() waited %v for a silent client", waited)
+	}
+	// the deadline is gone again
+	client.Write([]byte("220 "))
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := server.Read(make([]byte, 4)); err != nil {
+		t.Errorf("read after peeking: %v", err)
+	}
+}
+
+func TestPeekSSHNotSniffed(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+	banner := "SSH-2.0-OpenSSH_9.6\r\n"
+	client.Write([]byte(banner))
+	p := peekClient(server, time.Second, true, true)
+	if p.protocol != protoSSH || p.hostname != "" || string(p.peeked) != banner {
+		t.Errorf("peekClient() = %s %q %q, want ssh and the banner", p.protocol, p.hostname, p.peeked)
+	}
+}
+
+func TestSniffSNI(t *testing.T) {
+	for _, sni := range []bool{true, false} {
+		client, server := tcpPair(t)
+		go tls.Client(client, &tls.Config{ServerName: "secure.example.com"}).Handshake()
+		p := peekClient(server, time.Second, sni, true)
+		want := ""
+		if sni {
+			want = "secure.example.com"
+		}
+		if p.hostname != want || p.protocol != protoTLS {
+			t.Errorf("peekClient() with sni=%v found %s %q, want tls %q", sni, p.protocol, p.hostname, want)
+		}
+		if len(p.peeked) == 0 || p.peeked[0] != tlsRecordTypeHandshake {
+			t.Errorf("peeked %x, want the ClientHello", p.peeked)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+// fakeUpstream accepts one connection, answers its CONNECT with status and,
+// if that is 200, returns everything sent after the CONNECT request.
+func fakeUpstream(t *testing.T, status string) (string, chan string, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	connects := make(chan string, 1)
+	after := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		br := bufio.NewReader(c)
+		var connect strings.Builder
+		for {
+			line, err := br.ReadString('\n')
+			connect.WriteString(line)
+			if err != nil || line == "\r\n" {
+				break
+			}
+		}
+		connects <- connect.String()
+		io.WriteString(c, status+"\r\n\r\n")
+		if !strings.Contains(status, "200") {
+			rest, _ := io.ReadAll(br)
+			after <- string(rest)
+			return
+		}
+		var rest bytes.Buffer
+		io.Copy(&rest, br)
+		after <- rest.String()
+	}()
+	return l.Addr().String(), connects, after
+}
+
+func TestSniffedBytesSentOnceToChosenProxy(t *testing.T) {
+	refusing, refusingConnects, refusingAfter := fakeUpstream(t, "HTTP/1.0 503 Service Unavailable")
+	accepting, acceptingConnects, acceptingAfter := fakeUpstream(t, "HTTP/1.0 200 Connection established")
+	cfg, _ := newProxyConfig([]string{refusing, accepting}, nil, nil)
+	cfg.hostSniffing = true
+	cfg.relayMode = relayGoroutine
+	orig := currentConfig()
+	setConfig(cfg)
+	defer setConfig(orig)
+
+	client, clientSide := tcpPair(t)
+	defer client.Close()
+	req := "GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"
+	client.Write([]byte(req))
+	p := peekClient(clientSide, time.Second, cfg.sniParsing, cfg.hostSniffing)
+	tun := handleProxyConnection(clientSide, "192.0.2.10", 80, p, cfg.proxyServers)
+	if tun == nil {
+		t.Fatalf("handleProxyConnection() did not set up a tunnel")
+	}
+	go relayTunnel(tun, tun.serverName())
+
+	for _, connects := range []chan string{refusingConnects, acceptingConnects} {
+		if got := <-connects; !strings.HasPrefix(got, "CONNECT www.example.com:80 HTTP/1.0\r\n") {
+			t.Errorf("upstream got %q, want a CONNECT for www.example.com:80", got)
+		}
+	}
+	client.Write([]byte("second request"))
+	client.CloseWrite()
+	if got := <-refusingAfter; got != "" {
+		t.Errorf("refusing upstream was sent %q after its CONNECT", got)
+	}
+	if got := <-acceptingAfter; got != req+"second request" {
+		t.Errorf("accepting upstream was sent %q, want %q", got, req+"second request")
+	}
+	tun.close()
+}
@@ -0,0 +1,245 @@
+//
+// state.go - Runtime state of any_proxy that can change without a restart
+//
+// Copyright (C) 2013 Ryan A. Chapman. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+//      this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+//      this list of conditions and the following disclaimer in the documentation
+//      and/or other materials provided with the distribution.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHORS
+// OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+// New connections take a snapshot of the proxyConfig when they start and use
+// it for their whole life. Changing the configuration means building a new
+// proxyConfig and swapping it in, so tunnels that are already up never see a
+// half-updated configuration and keep running undisturbed.
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	log "github.com/zdannar/flogger"
+)
+
+type proxyConfig struct {
+	proxyServers     []string          // upstream proxies, in the order they are tried
+	authProxyServers map[string]string // upstream proxy -> base64 encoded credentials
+	directs          []string          // IPs and CIDRs sent directly (-d)
+	director         func(*net.IP) (bool, int)
+	clientRedirects  bool            // -r
+	reverseLookups   bool            // -R
+	sniParsing       bool            // -S
+	hostSniffing     bool            // -hostsniff
+	classify         bool            // -classify
+	rules            []*rule         // -rules
+	httpPorts        map[uint16]bool // -httpports
+	verifyPolicy     string          // -verifyname
+	limits           connLimits
+	relayMode        string // -relay
+}
+
+var gConfig struct {
+	sync.RWMutex
+	cfg *proxyConfig
+}
+
+// serializes read-modify-write updates of gConfig
+var gConfigUpdate sync.Mutex
+
+func newProxyConfig(proxyServers []string, authProxyServers map[string]string, directs []string) (*proxyConfig, error) {
+	c := &proxyConfig{
+		proxyServers:     proxyServers,
+		authProxyServers: authProxyServers,
+	}
+	return c.withDirects(directs)
+}
+
+// withDirects returns a copy of c with its directs replaced
+func (c *proxyConfig) withDirects(directs []string) (*proxyConfig, error) {
+	for _, d := range directs {
+		if err := checkDirect(d); err != nil {
+			return nil, err
+		}
+	}
+	n := *c
+	n.directs = directs
+	n.director = getDirector(buildDirectors(strings.Join(directs, ",")))
+	return &n, nil
+}
+
+func currentConfig() *proxyConfig {
+	gConfig.RLock()
+	defer gConfig.RUnlock()
+	return gConfig.cfg
+}
+
+func setConfig(cfg *proxyConfig) {
+	gConfig.Lock()
+	gConfig.cfg = cfg
+	gConfig.Unlock()
+}
+
+// splitDirects turns a -d argument into a list of IPs and CIDRs
+func splitDirects(directs string) []string {
+	var ret []string
+	for _, d := range strings.Split(directs, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			ret = append(ret, d)
+		}
+	}
+	return ret
+}
+
+// checkDirect returns an error if d is neither an IP address nor a CIDR,
+// instead of letting buildDirectors panic on it.
+func checkDirect(d string) error {
+	if strings.Contains(d, "/") {
+		if _, _, err := net.ParseCIDR(d); err != nil {
+			return fmt.Errorf("unable to parse CIDR string %q: %v", d, err)
+		}
+		return nil
+	}
+	if net.ParseIP(d) == nil {
+		return fmt.Errorf("unable to parse IP address %q", d)
+	}
+	return nil
+}
+
+func addDirect(d string) error {
+	if err := checkDirect(d); err != nil {
+		return err
+	}
+	gConfigUpdate.Lock()
+	defer gConfigUpdate.Unlock()
+	cur := currentConfig()
+	for _, existing := range cur.directs {
+		if existing == d {
+			return nil
+		}
+	}
+	directs := append(append([]string{}, cur.directs...), d)
+	cfg, err := cur.withDirects(directs)
+	if err != nil {
+		return err
+	}
+	setConfig(cfg)
+	log.Infof("Added direct %s", d)
+	return nil
+}
+
+func removeDirect(d string) error {
+	gConfigUpdate.Lock()
+	defer gConfigUpdate.Unlock()
+	cur := currentConfig()
+	var directs []string
+	for _, existing := range cur.directs {
+		if existing != d {
+			directs = append(directs, existing)
+		}
+	}
+	if len(directs) == len(cur.directs) {
+		return fmt.Errorf("%s is not a direct", d)
+	}
+	cfg, err := cur.withDirects(directs)
+	if err != nil {
+		return err
+	}
+	setConfig(cfg)
+	log.Infof("Removed direct %s", d)
+	return nil
+}
+
+// Upstream states set through the admin API. They are kept apart from
+// proxyConfig so that they survive a configuration reload.
+const (
+	upstreamUp       = "up"
+	upstreamDraining = "draining" // no new connections, existing tunnels keep running
+	upstreamDown     = "down"     // no new connections, existing tunnels are closed
+)
+
+var gUpstreamStates struct {
+	sync.RWMutex
+	m map[string]string
+}
+
+func upstreamState(spec string) string {
+	gUpstreamStates.RLock()
+	defer gUpstreamStates.RUnlock()
+	if s, ok := gUpstreamStates.m[spec]; ok {
+		return s
+	}
+	return upstreamUp
+}
+
+// upstreams returns the upstream proxies of -p and then the others that rules
+// send connections to.
+func (c *proxyConfig) upstreams() []string {
+	ret := append([]string(nil), c.proxyServers...)
+	seen := make(map[string]bool)
+	for _, spec := range ret {
+		seen[spec] = true
+	}
+	for _, r := range c.rules {
+		if r.action == ruleProxy && !seen[r.upstream] {
+			seen[r.upstream] = true
+			ret = append(ret, r.upstream)
+		}
+	}
+	return ret
+}
+
+func setUpstreamState(spec, state string) error {
+	known := false
+	for _, p := range currentConfig().upstreams() {
+		if p == spec {
+			known = true
+		}
+	}
+	if !known {
+		return fmt.Errorf("%s is not an upstream proxy", spec)
+	}
+	switch state {
+	case upstreamUp, upstreamDraining, upstreamDown:
+	default:
+		return errors.New("state must be one of up, draining or down")
+	}
+
+	gUpstreamStates.Lock()
+	if gUpstreamStates.m == nil {
+		gUpstreamStates.m = make(map[string]string)
+	}
+	if state == upstreamUp {
+		delete(gUpstreamStates.m, spec)
+	} else {
+		gUpstreamStates.m[spec] = state
+	}
+	gUpstreamStates.Unlock()
+	log.Infof("Upstream proxy %s is now %s", spec, state)
+
+	if state == upstreamDown {
+		n := closeTunnelsVia(spec)
+		log.Infof("Closed %d tunnels through upstream proxy %s", n, spec)
+	}
+	return nil
+}
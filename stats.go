@@ -52,11 +52,141 @@ var acceptSuccesses struct {
     n uint64
 }
 
+var acceptFdLimitErrors struct {
+    sync.Mutex
+    n uint64
+}
+
+var acceptTemporaryErrors struct {
+    sync.Mutex
+    n uint64
+}
+
+var acceptOtherErrors struct {
+    sync.Mutex
+    n uint64
+}
+
+var shedTunnels struct {
+    sync.Mutex
+    n uint64
+}
+
+var limitTotalRefused struct {
+    sync.Mutex
+    n uint64
+}
+
+var limitClientRefused struct {
+    sync.Mutex
+    n uint64
+}
+
+var limitDestRefused struct {
+    sync.Mutex
+    n uint64
+}
+
+var limitRateRefused struct {
+    sync.Mutex
+    n uint64
+}
+
+var limitQueued struct {
+    sync.Mutex
+    n uint64
+}
+
 var getOriginalDstErrors struct {
     sync.Mutex
     n uint64
 }
 
+var reverseCacheHits struct {
+    sync.Mutex
+    n uint64
+}
+
+var reverseCacheNegativeHits struct {
+    sync.Mutex
+    n uint64
+}
+
+var reverseCacheMisses struct {
+    sync.Mutex
+    n uint64
+}
+
+var reverseCacheExpired struct {
+    sync.Mutex
+    n uint64
+}
+
+var reverseLookupTimeouts struct {
+    sync.Mutex
+    n uint64
+}
+
+var reverseLookupFailures struct {
+    sync.Mutex
+    n uint64
+}
+
+var dnsQueries struct {
+    sync.Mutex
+    n uint64
+}
+
+var dnsUpstreamErrors struct {
+    sync.Mutex
+    n uint64
+}
+
+var dnsRefused struct {
+    sync.Mutex
+    n uint64
+}
+
+var dnsAddressesRecorded struct {
+    sync.Mutex
+    n uint64
+}
+
+var httpRequestsForwarded struct {
+    sync.Mutex
+    n uint64
+}
+
+var httpNoResponses struct {
+    sync.Mutex
+    n uint64
+}
+
+var protocolConnections struct {
+    sync.Mutex
+    n map[string]uint64
+}
+
+var ruleDenied struct {
+    sync.Mutex
+    n uint64
+}
+
+var ruleRouted struct {
+    sync.Mutex
+    n uint64
+}
+
+var destinationMismatches struct {
+    sync.Mutex
+    n uint64
+}
+
+var destinationLookupFailures struct {
+    sync.Mutex
+    n uint64
+}
+
 var directConnections struct {
     sync.Mutex
     n uint64
@@ -132,6 +262,96 @@ func numAcceptSuccesses() (uint64) {
     return acceptSuccesses.n
 }
 
+func incrAcceptFdLimitErrors() {
+    acceptFdLimitErrors.Lock()
+    acceptFdLimitErrors.n++
+    acceptFdLimitErrors.Unlock()
+}
+
+func numAcceptFdLimitErrors() (uint64) {
+    return acceptFdLimitErrors.n
+}
+
+func incrAcceptTemporaryErrors() {
+    acceptTemporaryErrors.Lock()
+    acceptTemporaryErrors.n++
+    acceptTemporaryErrors.Unlock()
+}
+
+func numAcceptTemporaryErrors() (uint64) {
+    return acceptTemporaryErrors.n
+}
+
+func incrAcceptOtherErrors() {
+    acceptOtherErrors.Lock()
+    acceptOtherErrors.n++
+    acceptOtherErrors.Unlock()
+}
+
+func numAcceptOtherErrors() (uint64) {
+    return acceptOtherErrors.n
+}
+
+func incrShedTunnels() {
+    shedTunnels.Lock()
+    shedTunnels.n++
+    shedTunnels.Unlock()
+}
+
+func numShedTunnels() (uint64) {
+    return shedTunnels.n
+}
+
+func incrLimitTotalRefused() {
+    limitTotalRefused.Lock()
+    limitTotalRefused.n++
+    limitTotalRefused.Unlock()
+}
+
+func numLimitTotalRefused() (uint64) {
+    return limitTotalRefused.n
+}
+
+func incrLimitClientRefused() {
+    limitClientRefused.Lock()
+    limitClientRefused.n++
+    limitClientRefused.Unlock()
+}
+
+func numLimitClientRefused() (uint64) {
+    return limitClientRefused.n
+}
+
+func incrLimitDestRefused() {
+    limitDestRefused.Lock()
+    limitDestRefused.n++
+    limitDestRefused.Unlock()
+}
+
+func numLimitDestRefused() (uint64) {
+    return limitDestRefused.n
+}
+
+func incrLimitRateRefused() {
+    limitRateRefused.Lock()
+    limitRateRefused.n++
+    limitRateRefused.Unlock()
+}
+
+func numLimitRateRefused() (uint64) {
+    return limitRateRefused.n
+}
+
+func incrLimitQueued() {
+    limitQueued.Lock()
+    limitQueued.n++
+    limitQueued.Unlock()
+}
+
+func numLimitQueued() (uint64) {
+    return limitQueued.n
+}
+
 func incrGetOriginalDstErrors() {
     getOriginalDstErrors.Lock()
     getOriginalDstErrors.n++
@@ -142,6 +362,181 @@ func numGetOriginalDstErrors() (uint64) {
     return getOriginalDstErrors.n
 }
 
+func incrReverseCacheHits() {
+    reverseCacheHits.Lock()
+    reverseCacheHits.n++
+    reverseCacheHits.Unlock()
+}
+
+func numReverseCacheHits() (uint64) {
+    return reverseCacheHits.n
+}
+
+func incrReverseCacheNegativeHits() {
+    reverseCacheNegativeHits.Lock()
+    reverseCacheNegativeHits.n++
+    reverseCacheNegativeHits.Unlock()
+}
+
+func numReverseCacheNegativeHits() (uint64) {
+    return reverseCacheNegativeHits.n
+}
+
+func incrReverseCacheMisses() {
+    reverseCacheMisses.Lock()
+    reverseCacheMisses.n++
+    reverseCacheMisses.Unlock()
+}
+
+func numReverseCacheMisses() (uint64) {
+    return reverseCacheMisses.n
+}
+
+func incrReverseCacheExpired() {
+    reverseCacheExpired.Lock()
+    reverseCacheExpired.n++
+    reverseCacheExpired.Unlock()
+}
+
+func numReverseCacheExpired() (uint64) {
+    return reverseCacheExpired.n
+}
+
+func incrReverseLookupTimeouts() {
+    reverseLookupTimeouts.Lock()
+    reverseLookupTimeouts.n++
+    reverseLookupTimeouts.Unlock()
+}
+
+func numReverseLookupTimeouts() (uint64) {
+    return reverseLookupTimeouts.n
+}
+
+func incrReverseLookupFailures() {
+    reverseLookupFailures.Lock()
+    reverseLookupFailures.n++
+    reverseLookupFailures.Unlock()
+}
+
+func numReverseLookupFailures() (uint64) {
+    return reverseLookupFailures.n
+}
+
+func incrDNSQueries() {
+    dnsQueries.Lock()
+    dnsQueries.n++
+    dnsQueries.Unlock()
+}
+
+func numDNSQueries() (uint64) {
+    return dnsQueries.n
+}
+
+func incrDNSUpstreamErrors() {
+    dnsUpstreamErrors.Lock()
+    dnsUpstreamErrors.n++
+    dnsUpstreamErrors.Unlock()
+}
+
+func numDNSUpstreamErrors() (uint64) {
+    return dnsUpstreamErrors.n
+}
+
+func incrDNSRefused() {
+    dnsRefused.Lock()
+    dnsRefused.n++
+    dnsRefused.Unlock()
+}
+
+func numDNSRefused() (uint64) {
+    return dnsRefused.n
+}
+
+func incrDNSAddressesRecorded() {
+    dnsAddressesRecorded.Lock()
+    dnsAddressesRecorded.n++
+    dnsAddressesRecorded.Unlock()
+}
+
+func numDNSAddressesRecorded() (uint64) {
+    return dnsAddressesRecorded.n
+}
+
+func incrHTTPRequestsForwarded() {
+    httpRequestsForwarded.Lock()
+    httpRequestsForwarded.n++
+    httpRequestsForwarded.Unlock()
+}
+
+func numHTTPRequestsForwarded() (uint64) {
+    return httpRequestsForwarded.n
+}
+
+func incrHTTPNoResponses() {
+    httpNoResponses.Lock()
+    httpNoResponses.n++
+    httpNoResponses.Unlock()
+}
+
+func numHTTPNoResponses() (uint64) {
+    return httpNoResponses.n
+}
+
+func incrProtocolConnections(protocol string) {
+    protocolConnections.Lock()
+    if protocolConnections.n == nil {
+        protocolConnections.n = make(map[string]uint64)
+    }
+    protocolConnections.n[protocol]++
+    protocolConnections.Unlock()
+}
+
+func numProtocolConnections(protocol string) (uint64) {
+    protocolConnections.Lock()
+    defer protocolConnections.Unlock()
+    return protocolConnections.n[protocol]
+}
+
+func incrRuleDenied() {
+    ruleDenied.Lock()
+    ruleDenied.n++
+    ruleDenied.Unlock()
+}
+
+func numRuleDenied() (uint64) {
+    return ruleDenied.n
+}
+
+func incrRuleRouted() {
+    ruleRouted.Lock()
+    ruleRouted.n++
+    ruleRouted.Unlock()
+}
+
+func numRuleRouted() (uint64) {
+    return ruleRouted.n
+}
+
+func incrDestinationMismatches() {
+    destinationMismatches.Lock()
+    destinationMismatches.n++
+    destinationMismatches.Unlock()
+}
+
+func numDestinationMismatches() (uint64) {
+    return destinationMismatches.n
+}
+
+func incrDestinationLookupFailures() {
+    destinationLookupFailures.Lock()
+    destinationLookupFailures.n++
+    destinationLookupFailures.Unlock()
+}
+
+func numDestinationLookupFailures() (uint64) {
+    return destinationLookupFailures.n
+}
+
 func incrDirectConnections() {
     directConnections.Lock()
     directConnections.n++
@@ -257,37 +652,74 @@ func setupStats() {
     signal.Notify(c, syscall.SIGUSR1)
     go func() {
         for _ = range c {
-            f, err := os.Create(gStatsFile)
-            if err != nil {
-                log.Infof("ERR: Could not open stats file \"%s\": %v", gStatsFile, err)
-                continue
-            }
-            fmt.Fprintf(f, "%s\n\n", versionString())
-            fmt.Fprintf(f, "STATISTICS as of %v:\n", time.Now().Format(time.UnixDate))
-            fmt.Fprintf(f, "                                Go version: %v\n", runtime.Version())
-            fmt.Fprintf(f, "          Number of logical CPUs on system: %v\n", runtime.NumCPU())
-            fmt.Fprintf(f, "                                GOMAXPROCS: %v\n", runtime.GOMAXPROCS(-1))
-            fmt.Fprintf(f, "              Goroutines currently running: %v\n", runtime.NumGoroutine())
-            fmt.Fprintf(f, "     Number of cgo calls made by any_proxy: %v\n", runtime.NumCgoCall())
-            fmt.Fprintf(f, "\n")
-            fmt.Fprintf(f, "                          accept successes: %v\n", numAcceptSuccesses())
-            fmt.Fprintf(f, "                             accept errors: %v\n", numAcceptErrors())
-            fmt.Fprintf(f, "        getsockopt(SO_ORIGINAL_DST) errors: %v\n", numGetOriginalDstErrors())
-            fmt.Fprintf(f, "\n")
-            fmt.Fprintf(f, "                 connections sent directly: %v\n", numDirectConnections())
-            fmt.Fprintf(f, "             direct connection read errors: %v\n", numDirectServerReadErr())
-            fmt.Fprintf(f, "            direct connection write errors: %v\n", numDirectServerWriteErr())
-            fmt.Fprintf(f, "\n")
-            fmt.Fprintf(f, "        connections sent to upstream proxy: %v\n", numProxiedConnections())
-            fmt.Fprintf(f, "              proxy connection read errors: %v\n", numProxyServerReadErr())
-            fmt.Fprintf(f, "             proxy connection write errors: %v\n", numProxyServerWriteErr())
-            fmt.Fprintf(f, "           code 200 response from upstream: %v\n", numProxy200Responses())
-            fmt.Fprintf(f, "           code 400 response from upstream: %v\n", numProxy400Responses())
-            fmt.Fprintf(f, "other (non 200/400) response from upstream: %v\n", numProxyNon200Responses())
-            fmt.Fprintf(f, "      no response to CONNECT from upstream: %v\n", numProxyNoConnectResponses())
-            f.Close()
+            writeStats()
         }
     }()
 }
 
+func writeStats() {
+    f, err := os.Create(gStatsFile)
+    if err != nil {
+        log.Infof("ERR: Could not open stats file \"%s\": %v", gStatsFile, err)
+        return
+    }
+    fmt.Fprintf(f, "%s\n\n", versionString())
+    fmt.Fprintf(f, "STATISTICS as of %v:\n", time.Now().Format(time.UnixDate))
+    fmt.Fprintf(f, "                                Go version: %v\n", runtime.Version())
+    fmt.Fprintf(f, "          Number of logical CPUs on system: %v\n", runtime.NumCPU())
+    fmt.Fprintf(f, "                                GOMAXPROCS: %v\n", runtime.GOMAXPROCS(-1))
+    fmt.Fprintf(f, "              Goroutines currently running: %v\n", runtime.NumGoroutine())
+    fmt.Fprintf(f, "     Number of cgo calls made by any_proxy: %v\n", runtime.NumCgoCall())
+    fmt.Fprintf(f, "\n")
+    fmt.Fprintf(f, "                    tunnels currently open: %v\n", numActiveTunnels())
+    fmt.Fprintf(f, "                          accept successes: %v\n", numAcceptSuccesses())
+    fmt.Fprintf(f, "                             accept errors: %v\n", numAcceptErrors())
+    fmt.Fprintf(f, "    accept errors: out of file descriptors: %v\n", numAcceptFdLimitErrors())
+    fmt.Fprintf(f, "                  accept errors: temporary: %v\n", numAcceptTemporaryErrors())
+    fmt.Fprintf(f, "                 accept errors: unexpected: %v\n", numAcceptOtherErrors())
+    fmt.Fprintf(f, "        idle tunnels closed to free up fds: %v\n", numShedTunnels())
+    fmt.Fprintf(f, "        getsockopt(SO_ORIGINAL_DST) errors: %v\n", numGetOriginalDstErrors())
+    fmt.Fprintf(f, "\n")
+    fmt.Fprintf(f, "                 refused: too many tunnels: %v\n", numLimitTotalRefused())
+    fmt.Fprintf(f, "     refused: too many tunnels from client: %v\n", numLimitClientRefused())
+    fmt.Fprintf(f, "  refused: too many tunnels to destination: %v\n", numLimitDestRefused())
+    fmt.Fprintf(f, "             refused: client rate exceeded: %v\n", numLimitRateRefused())
+    fmt.Fprintf(f, "                queued waiting for a limit: %v\n", numLimitQueued())
+    fmt.Fprintf(f, "\n")
+    fmt.Fprintf(f, "                 reverse lookup cache hits: %v\n", numReverseCacheHits())
+    fmt.Fprintf(f, " reverse lookup cache hits: failed lookups: %v\n", numReverseCacheNegativeHits())
+    fmt.Fprintf(f, "               reverse lookup cache misses: %v\n", numReverseCacheMisses())
+    fmt.Fprintf(f, "      reverse lookup cache entries expired: %v\n", numReverseCacheExpired())
+    fmt.Fprintf(f, "      reverse lookups not answered in time: %v\n", numReverseLookupTimeouts())
+    fmt.Fprintf(f, "                    reverse lookups failed: %v\n", numReverseLookupFailures())
+    fmt.Fprintf(f, "\n")
+    fmt.Fprintf(f, "              DNS queries forwarded (-dns): %v\n", numDNSQueries())
+    fmt.Fprintf(f, "           DNS queries failed at resolvers: %v\n", numDNSUpstreamErrors())
+    fmt.Fprintf(f, "    DNS clients refused (not in -dnsallow): %v\n", numDNSRefused())
+    fmt.Fprintf(f, "       addresses recorded from DNS answers: %v\n", numDNSAddressesRecorded())
+    fmt.Fprintf(f, "\n")
+    for _, protocol := range protocols {
+        fmt.Fprintf(f, "%42s: %v\n", "clients speaking " + protocol, numProtocolConnections(protocol))
+    }
+    fmt.Fprintf(f, "              connections denied by -rules: %v\n", numRuleDenied())
+    fmt.Fprintf(f, "              connections routed by -rules: %v\n", numRuleRouted())
+    fmt.Fprintf(f, "            mismatched names (-verifyname): %v\n", numDestinationMismatches())
+    fmt.Fprintf(f, "            unresolved names (-verifyname): %v\n", numDestinationLookupFailures())
+    fmt.Fprintf(f, "\n")
+    fmt.Fprintf(f, "                 connections sent directly: %v\n", numDirectConnections())
+    fmt.Fprintf(f, "             direct connection read errors: %v\n", numDirectServerReadErr())
+    fmt.Fprintf(f, "            direct connection write errors: %v\n", numDirectServerWriteErr())
+    fmt.Fprintf(f, "\n")
+    fmt.Fprintf(f, "        connections sent to upstream proxy: %v\n", numProxiedConnections())
+    fmt.Fprintf(f, "              proxy connection read errors: %v\n", numProxyServerReadErr())
+    fmt.Fprintf(f, "             proxy connection write errors: %v\n", numProxyServerWriteErr())
+    fmt.Fprintf(f, "           code 200 response from upstream: %v\n", numProxy200Responses())
+    fmt.Fprintf(f, "           code 400 response from upstream: %v\n", numProxy400Responses())
+    fmt.Fprintf(f, "other (non 200/400) response from upstream: %v\n", numProxyNon200Responses())
+    fmt.Fprintf(f, "      no response to CONNECT from upstream: %v\n", numProxyNoConnectResponses())
+    fmt.Fprintf(f, "      HTTP requests forwarded (-httpports): %v\n", numHTTPRequestsForwarded())
+    fmt.Fprintf(f, "   HTTP requests with no upstream response: %v\n", numHTTPNoResponses())
+    f.Close()
+}
+
 
@@ -0,0 +1,198 @@
+//
+// systemd.go - systemd socket activation, readiness notification and watchdog
+//
+// Copyright (C) 2013 Ryan A. Chapman. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+//      this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+//      this list of conditions and the following disclaimer in the documentation
+//      and/or other materials provided with the distribution.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHORS
+// OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+// Sockets passed by systemd (LISTEN_FDS) are treated like the ones inherited
+// on upgrade: the one named "admin" (FileDescriptorName=admin) is used for the
+// admin API, the ones named "dns" and "dnsudp" for the DNS forwarder's TCP and
+// UDP sockets, and the first other one replaces -l. See systemd/ for unit files.
+//
+// None of this does anything unless systemd sets LISTEN_FDS, NOTIFY_SOCKET or
+// WATCHDOG_USEC, so any_proxy still runs the same everywhere else.
+//
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	log "github.com/zdannar/flogger"
+)
+
+const sdListenFdsStart = 3
+
+// loadSystemdFiles picks up the sockets passed by systemd, if any.
+func loadSystemdFiles() {
+	loadListenFds(sdListenFdsStart)
+}
+
+// loadListenFds does the work for loadSystemdFiles, with the sockets starting at fd start.
+func loadListenFds(start int) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := 0; i < n; i++ {
+		fd := start + i
+		syscall.CloseOnExec(fd)
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		if name != "admin" && name != "dns" && name != "dnsudp" {
+			if _, ok := gInheritedFiles["listen"]; ok {
+				// only one listener is supported
+				syscall.Close(fd)
+				continue
+			}
+			name = "listen"
+		}
+		gInheritedFiles[name] = os.NewFile(uintptr(fd), name)
+	}
+	gInheritedFrom = "systemd"
+}
+
+// sdNotify sends state to systemd's notification socket. It does nothing if
+// we weren't started by systemd with Type=notify.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if addr[0] == '@' {
+		// abstract namespace
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+func sdNotifyf(format string, v ...interface{}) {
+	if err := sdNotify(fmt.Sprintf(format, v...)); err != nil {
+		log.Debugf("sdNotify(): %v", err)
+	}
+}
+
+func sdStatus() string {
+	return fmt.Sprintf("STATUS=%d tunnels open, %d connections accepted", numActiveTunnels(), numAcceptSuccesses())
+}
+
+// monotonicUsec is CLOCK_MONOTONIC in microseconds, as systemd wants it with RELOADING=1.
+func monotonicUsec() int64 {
+	var ts syscall.Timespec
+	syscall.Syscall(syscall.SYS_CLOCK_GETTIME, 1, uintptr(unsafe.Pointer(&ts)), 0) // CLOCK_MONOTONIC
+	return ts.Nano() / 1000
+}
+
+// The accept loop reports here, so that the watchdog only pings systemd while
+// the loop is either waiting for connections or making progress.
+var gAcceptLoop struct {
+	sync.Mutex
+	accepting  bool
+	iterations uint64
+}
+
+func acceptLoopWaiting(waiting bool) {
+	gAcceptLoop.Lock()
+	gAcceptLoop.accepting = waiting
+	if !waiting {
+		gAcceptLoop.iterations++
+	}
+	gAcceptLoop.Unlock()
+}
+
+// acceptLoopAlive reports whether the accept loop is waiting in accept or has
+// moved on since the iteration count in *last, which it updates.
+func acceptLoopAlive(last *uint64) bool {
+	gAcceptLoop.Lock()
+	defer gAcceptLoop.Unlock()
+	alive := gAcceptLoop.accepting || gAcceptLoop.iterations != *last
+	*last = gAcceptLoop.iterations
+	return alive
+}
+
+// watchdogInterval returns how often systemd expects WATCHDOG=1, or 0 if
+// the watchdog isn't enabled for us.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID")); err == nil && pid != os.Getpid() {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+func setupWatchdog() {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	log.Infof("systemd: watchdog enabled, pinging every %v", interval/2)
+	go watchdog(interval/2, nil)
+}
+
+// watchdog pings systemd every interval for as long as the accept loop looks
+// alive, until stop is closed.
+func watchdog(interval time.Duration, stop chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var last uint64
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if !acceptLoopAlive(&last) {
+			log.Infof("ERR: accept loop is not making progress, withholding watchdog ping")
+			continue
+		}
+		sdNotifyf("WATCHDOG=1\n%s", sdStatus())
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeNotifySocket listens where NOTIFY_SOCKET points, like systemd does.
+func fakeNotifySocket(t *testing.T, name string) *net.UnixConn {
+	t.Setenv("NOTIFY_SOCKET", name)
+	if name[0] == '@' {
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("could not listen on fake notify socket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readNotify(t *testing.T, conn *net.UnixConn, timeout time.Duration) string {
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	n, err := conn.Read(buf)
+	if err != nil {
+		return ""
+	}
+	return string(buf[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+	for _, name := range []string{filepath.Join(t.TempDir(), "notify"), "@any_proxy_test_" + strconv.Itoa(os.Getpid())} {
+		conn := fakeNotifySocket(t, name)
+		if err := sdNotify("READY=1\nSTATUS=ok"); err != nil {
+			t.Fatalf("sdNotify() to %q failed: %v", name, err)
+		}
+		if got := readNotify(t, conn, time.Second); got != "READY=1\nSTATUS=ok" {
+			t.Errorf("notify socket %q got %q, want READY=1", name, got)
+		}
+	}
+
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("sdNotify() without NOTIFY_SOCKET should do nothing, got %v", err)
+	}
+}
+
+func TestReloadNotifiesSystemd(t *testing.T) {
+	conn := fakeNotifySocket(t, filepath.Join(t.TempDir(), "notify"))
+	sdNotifyf("RELOADING=1\nMONOTONIC_USEC=%d", monotonicUsec())
+	got := readNotify(t, conn, time.Second)
+	if !strings.HasPrefix(got, "RELOADING=1\nMONOTONIC_USEC=") {
+		t.Fatalf("got %q, want RELOADING=1", got)
+	}
+	usec, err := strconv.ParseInt(strings.TrimPrefix(got, "RELOADING=1\nMONOTONIC_USEC="), 10, 64)
+	if err != nil || usec <= 0 {
+		t.Errorf("bad MONOTONIC_USEC in %q", got)
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	conn := fakeNotifySocket(t, filepath.Join(t.TempDir(), "notify"))
+	stop := make(chan bool)
+	defer close(stop)
+
+	// waiting in accept counts as alive
+	acceptLoopWaiting(true)
+	go watchdog(10*time.Millisecond, stop)
+	if got := readNotify(t, conn, time.Second); !strings.HasPrefix(got, "WATCHDOG=1\n") {
+		t.Fatalf("got %q, want a WATCHDOG=1 ping while the accept loop is waiting", got)
+	}
+
+	// stuck outside accept, so the pings have to stop
+	acceptLoopWaiting(false)
+	for readNotify(t, conn, 50*time.Millisecond) != "" {
+	}
+	if got := readNotify(t, conn, 100*time.Millisecond); got != "" {
+		t.Errorf("got %q while the accept loop was stuck, want no ping", got)
+	}
+
+	// making progress again
+	acceptLoopWaiting(true)
+	if got := readNotify(t, conn, time.Second); !strings.HasPrefix(got, "WATCHDOG=1\n") {
+		t.Errorf("got %q, want pings to resume", got)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if got := watchdogInterval(); got != 30*time.Second {
+		t.Errorf("watchdogInterval() = %v, want 30s", got)
+	}
+	t.Setenv("WATCHDOG_PID", "1")
+	if got := watchdogInterval(); got != 0 {
+		t.Errorf("watchdogInterval() = %v for another pid, want 0", got)
+	}
+}
+
+func TestLoadListenFds(t *testing.T) {
+	orig, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer orig.Close()
+	f, err := orig.File()
+	if err != nil {
+		t.Fatalf("could not get listener file: %v", err)
+	}
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatalf("dup failed: %v", err)
+	}
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_FDNAMES", "any_proxy.socket")
+	defer func(from string) { gInheritedFrom = from }(gInheritedFrom)
+	loadListenFds(fd)
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Errorf("LISTEN_FDS should be unset so it isn't passed on to children")
+	}
+
+	l, err := listen("127.0.0.1:1")
+	if err != nil {
+		t.Fatalf("listen() with a systemd socket failed: %v", err)
+	}
+	defer l.Close()
+	if l.Addr().String() != orig.Addr().String() {
+		t.Errorf("listen() bound %v, want the systemd socket on %v", l.Addr(), orig.Addr())
+	}
+}
@@ -0,0 +1,329 @@
+//
+// tunnels.go - Registry of the tunnels any_proxy is currently relaying
+//
+// Copyright (C) 2013 Ryan A. Chapman. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+//      this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+//      this list of conditions and the following disclaimer in the documentation
+//      and/or other materials provided with the distribution.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHORS
+// OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	log "github.com/zdannar/flogger"
+)
+
+const viaDirect = "direct"
+
+// A tunnel is a client connection being relayed to a server, either directly
+// or through an upstream proxy.
+type tunnel struct {
+	id      uint64
+	client  net.Conn
+	server  net.Conn
+	dst     string // original destination, ip:port
+	via     string // upstream proxy spec or viaDirect
+	started time.Time
+	relay   func(*tunnel) string // relays the tunnel instead of copying bytes, if set
+
+	closeOnce sync.Once
+	closed    int32 // set once close() has been called, accessed atomically
+
+	mu        sync.Mutex
+	closeHook func()      // called by close(), after the connections are closed
+	onDone    []func()    // called once the tunnel has been relayed to the end
+	peek      *clientPeek // what the client sent first, if that was looked at
+}
+
+var gTunnels struct {
+	sync.Mutex
+	m        map[uint64]*tunnel
+	next     uint64
+	finished uint64 // tunnels that have been relayed to the end
+}
+
+func trackTunnel(client, server net.Conn, dst, via string) *tunnel {
+	gTunnels.Lock()
+	defer gTunnels.Unlock()
+	if gTunnels.m == nil {
+		gTunnels.m = make(map[uint64]*tunnel)
+	}
+	gTunnels.next++
+	t := &tunnel{
+		id:      gTunnels.next,
+		client:  client,
+		server:  server,
+		dst:     dst,
+		via:     via,
+		started: time.Now(),
+	}
+	gTunnels.m[t.id] = t
+	return t
+}
+
+func untrackTunnel(t *tunnel) {
+	gTunnels.Lock()
+	if _, ok := gTunnels.m[t.id]; ok {
+		delete(gTunnels.m, t.id)
+		gTunnels.finished++
+	}
+	gTunnels.Unlock()
+}
+
+func numFinishedTunnels() uint64 {
+	gTunnels.Lock()
+	defer gTunnels.Unlock()
+	return gTunnels.finished
+}
+
+func (t *tunnel) close() {
+	t.closeOnce.Do(func() {
+		atomic.StoreInt32(&t.closed, 1)
+		t.client.Close()
+		t.server.Close()
+		t.mu.Lock()
+		hook := t.closeHook
+		t.mu.Unlock()
+		if hook != nil {
+			hook()
+		}
+	})
+}
+
+func (t *tunnel) isClosed() bool {
+	return atomic.LoadInt32(&t.closed) == 1
+}
+
+func (t *tunnel) setCloseHook(f func()) {
+	t.mu.Lock()
+	t.closeHook = f
+	t.mu.Unlock()
+}
+
+func (t *tunnel) setPeek(p *clientPeek) {
+	t.mu.Lock()
+	t.peek = p
+	t.mu.Unlock()
+}
+
+func (t *tunnel) clientPeek() *clientPeek {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.peek
+}
+
+// whenDone arranges for f to be called once the tunnel has been relayed to the end.
+func (t *tunnel) whenDone(f func()) {
+	t.mu.Lock()
+	t.onDone = append(t.onDone, f)
+	t.mu.Unlock()
+}
+
+// serverName is the name copy() knows the server end by.
+func (t *tunnel) serverName() string {
+	if t.via == viaDirect {
+		return "directserver"
+	}
+	return "proxyserver"
+}
+
+// idle returns how long it has been since data went either way through the
+// tunnel, according to the kernel. It is 0 if that can't be told.
+func (t *tunnel) idle() time.Duration {
+	c, err := tcpIdle(t.client)
+	if err != nil {
+		return 0
+	}
+	s, err := tcpIdle(t.server)
+	if err != nil {
+		return 0
+	}
+	if s < c {
+		return s
+	}
+	return c
+}
+
+// tcpIdle returns the time since data was last sent or received on conn.
+func tcpIdle(conn net.Conn) (time.Duration, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return 0, fmt.Errorf("%T is not a TCP connection", conn)
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var info syscall.TCPInfo
+	var errno syscall.Errno
+	err = rc.Control(func(fd uintptr) {
+		size := uint32(syscall.SizeofTCPInfo)
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, errno
+	}
+	ms := info.Last_data_recv
+	if info.Last_data_sent < ms {
+		ms = info.Last_data_sent
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+func (t *tunnel) String() string {
+	return fmt.Sprintf("%d|%v->%s->%s", t.id, t.client.RemoteAddr(), t.via, t.dst)
+}
+
+// relayTunnel copies data both ways until both directions are done, passing
+// on half-closes, then logs how the tunnel ended. servername is "proxyserver"
+// or "directserver", see copy(). With -relay=epoll, the tunnel is handed to
+// the epoll relay and relayTunnel returns straight away.
+func relayTunnel(t *tunnel, servername string) {
+	if t.relay != nil {
+		first := t.relay(t)
+		t.close()
+		t.relayDone(first)
+		return
+	}
+	if cfg := currentConfig(); cfg != nil && cfg.relayMode == relayEpoll && relayEpollTunnel(t, servername) {
+		return
+	}
+	ends := make(chan string, 2)
+	go func() {
+		ends <- t.endedBy(servername, copy(t.client, t.server, "client", servername))
+	}()
+	ends <- t.endedBy("client", copy(t.server, t.client, servername, "client"))
+	first := <-ends
+	<-ends
+	t.close()
+	t.relayDone(first)
+}
+
+// relayDone is called once both directions of t are done and it is closed.
+// first says how the first direction ended.
+func (t *tunnel) relayDone(first string) {
+	untrackTunnel(t)
+	if p := t.clientPeek(); p != nil {
+		first += ", protocol " + p.protocol
+		if p.hello != nil {
+			first += fmt.Sprintf(", ja3 %s, ja4 %s", p.hello.ja3(), p.hello.ja4())
+		}
+	}
+	log.Infof("TUNNEL|%v|Closed after %v, %s", t, time.Since(t.started).Truncate(time.Millisecond), first)
+	t.mu.Lock()
+	onDone := t.onDone
+	t.onDone = nil
+	t.mu.Unlock()
+	for _, f := range onDone {
+		f()
+	}
+}
+
+// endedBy describes why the copy from src stopped.
+func (t *tunnel) endedBy(src string, err error) string {
+	switch {
+	case t.isClosed():
+		return "closed by any_proxy"
+	case err != nil:
+		return fmt.Sprintf("%s error first: %v", src, err)
+	default:
+		return src + " closed first"
+	}
+}
+
+// watchIdleTunnels closes tunnels once no data has gone through them for timeout.
+func watchIdleTunnels(timeout time.Duration) {
+	interval := timeout / 4
+	if interval > 10*time.Second {
+		interval = 10 * time.Second
+	}
+	for _ = range time.Tick(interval) {
+		closeIdleTunnels(timeout)
+	}
+}
+
+func closeIdleTunnels(timeout time.Duration) int {
+	n := 0
+	for _, t := range activeTunnels() {
+		if idle := t.idle(); idle >= timeout {
+			log.Debugf("Closing tunnel %v, idle for %v", t, idle)
+			t.close()
+			n++
+		}
+	}
+	return n
+}
+
+// activeTunnels returns the tunnels currently being relayed, oldest first.
+func activeTunnels() []*tunnel {
+	gTunnels.Lock()
+	ret := make([]*tunnel, 0, len(gTunnels.m))
+	for _, t := range gTunnels.m {
+		ret = append(ret, t)
+	}
+	gTunnels.Unlock()
+	sort.Slice(ret, func(i, j int) bool { return ret[i].id < ret[j].id })
+	return ret
+}
+
+func numActiveTunnels() int {
+	gTunnels.Lock()
+	defer gTunnels.Unlock()
+	return len(gTunnels.m)
+}
+
+// closeTunnel closes the tunnel with the given id, returning false if there is none.
+func closeTunnel(id uint64) bool {
+	gTunnels.Lock()
+	t := gTunnels.m[id]
+	gTunnels.Unlock()
+	if t == nil {
+		return false
+	}
+	t.close()
+	return true
+}
+
+// closeTunnelsVia closes every tunnel going through upstream proxy spec and
+// returns how many there were.
+func closeTunnelsVia(spec string) int {
+	n := 0
+	for _, t := range activeTunnels() {
+		if t.via == spec {
+			t.close()
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+// The client sends its request and shuts down writing, the server only
+// answers once it has seen EOF. The answer must still make it back.
+func TestRelayHalfClose(t *testing.T) {
+	client, clientSide := tcpPair(t)
+	defer client.Close()
+	serverSide, server := tcpPair(t)
+	defer server.Close()
+
+	tun := trackTunnel(clientSide, serverSide, "192.0.2.1:7", viaDirect)
+	done := make(chan bool)
+	go func() {
+		relayTunnel(tun, "directserver")
+		done <- true
+	}()
+
+	client.Write([]byte("request"))
+	client.CloseWrite()
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	req, err := io.ReadAll(server)
+	if err != nil || string(req) != "request" {
+		t.Fatalf("server read %q, %v, want the request followed by EOF", req, err)
+	}
+	server.Write([]byte("response"))
+	server.CloseWrite()
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := io.ReadAll(client)
+	if err != nil || string(resp) != "response" {
+		t.Errorf("client read %q, %v, want the whole response after half-closing", resp, err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("relay did not finish once both sides had closed")
+	}
+}
+
+func TestCloseIdleTunnels(t *testing.T) {
+	client, clientSide := tcpPair(t)
+	defer client.Close()
+	serverSide, server := tcpPair(t)
+	defer server.Close()
+
+	tun := trackTunnel(clientSide, serverSide, "192.0.2.1:7", viaDirect)
+	done := make(chan bool)
+	go func() {
+		relayTunnel(tun, "directserver")
+		done <- true
+	}()
+
+	// half-closed and then nothing
+	client.CloseWrite()
+	if n := closeIdleTunnels(time.Hour); n != 0 {
+		t.Errorf("closeIdleTunnels() closed %d tunnels that were not idle long enough", n)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if n := closeIdleTunnels(200 * time.Millisecond); n != 1 {
+		t.Errorf("closeIdleTunnels() closed %d tunnels, want 1", n)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("relay did not finish after the idle tunnel was closed")
+	}
+}
@@ -0,0 +1,282 @@
+//
+// upgrade.go - Zero-downtime binary upgrade by handing the listener to a new process
+//
+// Copyright (C) 2013 Ryan A. Chapman. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+//      this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+//      this list of conditions and the following disclaimer in the documentation
+//      and/or other materials provided with the distribution.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHORS
+// OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+// On SIGUSR2, any_proxy starts whatever binary is now installed at os.Args[0]
+// with the same arguments, passing it the listening sockets as inherited fds.
+// The new process uses those instead of binding -l itself and says it is
+// ready over a pipe. Only then does the old process stop accepting and drain
+// its tunnels, exactly like on SIGTERM. If the new process dies or doesn't
+// become ready in time, the old one keeps on serving as if nothing happened.
+//
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/zdannar/flogger"
+)
+
+const SO_REUSEPORT = 15
+
+// names of the fds passed to the new process, which get fd 3, 4, ... in order
+const envInheritedFds = "ANY_PROXY_INHERITED_FDS"
+
+const upgradeReadyTimeout = 60 * time.Second
+
+var gInheritedFiles = map[string]*os.File{}
+var gInheritedFrom = "the previous any_proxy process"
+
+// loadInheritedFiles picks up the fds passed down by the process that started us, if any.
+func loadInheritedFiles() {
+	names := os.Getenv(envInheritedFds)
+	if names == "" {
+		return
+	}
+	os.Unsetenv(envInheritedFds)
+	for i, name := range strings.Split(names, ",") {
+		fd := uintptr(3 + i)
+		syscall.CloseOnExec(int(fd))
+		gInheritedFiles[name] = os.NewFile(fd, name)
+	}
+}
+
+// inheritedListener returns the listener passed down under name, or nil if there is none.
+func inheritedListener(name string) (net.Listener, error) {
+	f := gInheritedFiles[name]
+	if f == nil {
+		return nil, nil
+	}
+	delete(gInheritedFiles, name)
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// inheritedPacketConn returns the packet socket passed down under name, or nil if there is none.
+func inheritedPacketConn(name string) (net.PacketConn, error) {
+	f := gInheritedFiles[name]
+	if f == nil {
+		return nil, nil
+	}
+	delete(gInheritedFiles, name)
+	defer f.Close()
+	return net.FilePacketConn(f)
+}
+
+// listen binds the main listener, unless one was inherited.
+func listen(addr string) (*net.TCPListener, error) {
+	l, err := inheritedListener("listen")
+	if err != nil {
+		return nil, err
+	}
+	if l != nil {
+		log.Infof("Using listener inherited from %s", gInheritedFrom)
+	} else {
+		lc := net.ListenConfig{}
+		if gReusePort == 1 {
+			lc.Control = setReusePort
+		}
+		l, err = lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	tl, ok := l.(*net.TCPListener)
+	if !ok {
+		l.Close()
+		return nil, fmt.Errorf("listener is a %T, not a TCP listener", l)
+	}
+	return tl, nil
+}
+
+func setReusePort(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// notifyUpgradeReady tells the old process that we are accepting connections
+// and it can start draining.
+func notifyUpgradeReady() {
+	f := gInheritedFiles["ready"]
+	if f == nil {
+		return
+	}
+	delete(gInheritedFiles, "ready")
+	// with NotifyAccess=all, this makes systemd follow us instead of the old process
+	sdNotifyf("MAINPID=%d", os.Getpid())
+	fmt.Fprintf(f, "ready\n")
+	f.Close()
+}
+
+func setupUpgrade(listener *net.TCPListener) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR2)
+	go func() {
+		for _ = range c {
+			log.Infof("Received SIGUSR2, starting new any_proxy process")
+			pid, err := upgrade(listener)
+			if err != nil {
+				log.Infof("ERR: Upgrade failed, continuing to serve: %v", err)
+				continue
+			}
+			log.Infof("Upgrade: new any_proxy process %d is accepting connections, shutting down", pid)
+			shutdown(listener, gDrainTimeout)
+			os.Exit(0)
+		}
+	}()
+}
+
+// setNonblock puts the sockets of conns, which may be nil, in non-blocking
+// mode, which their accepts and reads count on.
+func setNonblock(conns ...interface{}) {
+	for _, c := range conns {
+		sc, ok := c.(syscall.Conn)
+		if !ok {
+			continue
+		}
+		rc, err := sc.SyscallConn()
+		if err != nil {
+			continue
+		}
+		rc.Control(func(fd uintptr) {
+			syscall.SetNonblock(int(fd), true)
+		})
+	}
+}
+
+// upgrade starts a new any_proxy process with our listeners and waits until
+// it is ready. It returns the new process' pid.
+func upgrade(listener *net.TCPListener) (int, error) {
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return 0, err
+	}
+
+	var names []string
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	f, err := listener.File()
+	if err != nil {
+		return 0, err
+	}
+	names = append(names, "listen")
+	files = append(files, f)
+
+	if al, ok := gAdminListener.(interface{ File() (*os.File, error) }); ok {
+		f, err := al.File()
+		if err != nil {
+			return 0, err
+		}
+		names = append(names, "admin")
+		files = append(files, f)
+	}
+
+	if dl, ok := gDNSListener.(interface{ File() (*os.File, error) }); ok {
+		f, err := dl.File()
+		if err != nil {
+			return 0, err
+		}
+		names = append(names, "dns")
+		files = append(files, f)
+	}
+	if dc, ok := gDNSConn.(interface{ File() (*os.File, error) }); ok {
+		f, err := dc.File()
+		if err != nil {
+			return 0, err
+		}
+		names = append(names, "dnsudp")
+		files = append(files, f)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	names = append(names, "ready")
+	files = append(files, w)
+
+	// so that the new process starts with what we have learned
+	saveReverseLookups()
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), envInheritedFds+"="+strings.Join(names, ","))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	err = cmd.Start()
+	// passing the sockets on took them out of non-blocking mode, which ours
+	// share with the copies
+	setNonblock(listener, gAdminListener, gDNSListener, gDNSConn)
+	// close our copies now, so that we see EOF on the pipe if the child dies
+	for _, f := range files {
+		f.Close()
+	}
+	files = nil
+	if err != nil {
+		return 0, err
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		line, err := bufio.NewReader(r).ReadString('\n')
+		if err == nil && line != "ready\n" {
+			err = fmt.Errorf("unexpected readiness message %q", line)
+		}
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(upgradeReadyTimeout):
+		err = fmt.Errorf("not ready after %v", upgradeReadyTimeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, errors.New("new process did not start: " + err.Error())
+	}
+	return cmd.Process.Pid, nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListenInherited(t *testing.T) {
+	orig, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	f, err := orig.File()
+	if err != nil {
+		t.Fatalf("could not get listener file: %v", err)
+	}
+	orig.Close()
+	gInheritedFiles["listen"] = f
+
+	l, err := listen("127.0.0.1:1")
+	if err != nil {
+		t.Fatalf("listen() with an inherited listener failed: %v", err)
+	}
+	defer l.Close()
+	if l.Addr().String() != orig.Addr().String() {
+		t.Errorf("listen() bound %v, want inherited listener on %v", l.Addr(), orig.Addr())
+	}
+
+	// the inherited socket is still listening even though orig was closed
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect to inherited listener: %v", err)
+	}
+	conn.Close()
+}
+
+func TestListenReusePort(t *testing.T) {
+	gReusePort = 1
+	defer func() { gReusePort = 0 }()
+
+	l1, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen() failed: %v", err)
+	}
+	defer l1.Close()
+	l2, err := listen(l1.Addr().String())
+	if err != nil {
+		t.Fatalf("second listen() on %v with -reuseport=1 failed: %v", l1.Addr(), err)
+	}
+	l2.Close()
+}
+
+// TestUpgrade runs an upgrade in a child process, which upgrade() re-executes
+// as the new process, since the old one exits and shutdown only runs once.
+func TestUpgrade(t *testing.T) {
+	switch os.Getenv("ANY_PROXY_TEST_UPGRADE") {
+	case "old":
+		upgradeOldChild(t)
+		return
+	case "new":
+		upgradeNewChild(t)
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestUpgrade$", "-test.v")
+	cmd.Env = append(os.Environ(), "ANY_PROXY_TEST_UPGRADE=old",
+		"ANY_PROXY_TEST_CACHE="+filepath.Join(t.TempDir(), "names"))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Errorf("upgrade failed: %v\n%s", err, out)
+	}
+}
+
+// upgradeOldChild is the running process: it upgrades with a tunnel open and
+// then drains, as on SIGUSR2.
+func upgradeOldChild(t *testing.T) {
+	gLookupCacheFile = os.Getenv("ANY_PROXY_TEST_CACHE")
+	gReverseLookupCache = NewReverseLookupCache(100, time.Hour)
+	gReverseLookupCache.store(netip.MustParseAddr("192.0.2.1"), "before.example.com")
+
+	l, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen(): %v", err)
+	}
+	gAdminAddr = filepath.Join(filepath.Dir(gLookupCacheFile), "admin.sock")
+	setupAdmin()
+	c1, c2 := net.Pipe()
+	s1, s2 := net.Pipe()
+	defer s2.Close()
+	tun := trackTunnel(c1, s1, "192.0.2.1:443", viaDirect)
+	go relayTunnel(tun, "directserver")
+
+	os.Setenv("ANY_PROXY_TEST_UPGRADE", "new")
+	pid, err := upgrade(l)
+	if err != nil {
+		t.Fatalf("upgrade(): %v", err)
+	}
+	if pid == os.Getpid() {
+		t.Fatalf("upgrade() returned our own pid")
+	}
+
+	// learned after the new process started, saved for the one after it
+	gReverseLookupCache.store(netip.MustParseAddr("192.0.2.2"), "after.example.com")
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		c2.Close()
+	}()
+	shutdown(l, 5*time.Second)
+	if n := numActiveTunnels(); n != 0 {
+		t.Errorf("%d tunnels still open after shutdown", n)
+	}
+	saved := NewReverseLookupCache(100, time.Hour)
+	if _, err := saved.load(gLookupCacheFile); err != nil {
+		t.Fatalf("could not load the saved cache: %v", err)
+	}
+	if name, _ := saved.lookup(netip.MustParseAddr("192.0.2.2")); name != "after.example.com" {
+		t.Errorf("cache saved on shutdown has %q for 192.0.2.2, want after.example.com", name)
+	}
+
+	// our listener is closed, but the socket lives on in the new process
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect after the upgrade: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	if line != "new before.example.com\n" {
+		t.Errorf("connection after the upgrade answered %q, want the new process", line)
+	}
+
+	// and so is our admin listener, the new process alone answers on it
+	admin, err := net.Dial("unix", gAdminAddr)
+	if err != nil {
+		t.Fatalf("could not connect to the admin socket after the upgrade: %v", err)
+	}
+	defer admin.Close()
+	admin.SetDeadline(time.Now().Add(10 * time.Second))
+	admin.Write([]byte("GET /upstreams HTTP/1.0\r\n\r\n"))
+	line, _ = bufio.NewReader(admin).ReadString('\n')
+	if line != "new admin\n" {
+		t.Errorf("admin request after the upgrade answered %q, want the new process", line)
+	}
+
+	p, _ := os.FindProcess(pid)
+	state, err := p.Wait()
+	if err != nil || !state.Success() {
+		t.Errorf("new process exited with %v, %v", state, err)
+	}
+}
+
+// upgradeNewChild is the process started by upgrade(). It answers one
+// connection on the listener it inherited, then one on the admin listener,
+// and exits.
+func upgradeNewChild(t *testing.T) {
+	loadInheritedFiles()
+	if gInheritedFiles["listen"] == nil || gInheritedFiles["admin"] == nil || gInheritedFiles["ready"] == nil {
+		t.Fatalf("inherited %v, want listen, admin and ready", gInheritedFiles)
+	}
+	admin, err := inheritedListener("admin")
+	if err != nil {
+		t.Fatalf("inheritedListener(admin): %v", err)
+	}
+	defer admin.Close()
+	l, err := listen("127.0.0.1:1")
+	if err != nil {
+		t.Fatalf("listen() with the inherited listener: %v", err)
+	}
+	defer l.Close()
+	gLookupCacheFile = os.Getenv("ANY_PROXY_TEST_CACHE")
+	setupReverseLookups()
+	name, _ := gReverseLookupCache.lookup(netip.MustParseAddr("192.0.2.1"))
+	notifyUpgradeReady()
+
+	l.SetDeadline(time.Now().Add(10 * time.Second))
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("no connection on the inherited listener: %v", err)
+	}
+	conn.Write([]byte(strings.Join([]string{"new", name}, " ") + "\n"))
+	conn.Close()
+
+	admin.(*net.UnixListener).SetDeadline(time.Now().Add(10 * time.Second))
+	conn, err = admin.Accept()
+	if err != nil {
+		t.Fatalf("no connection on the inherited admin listener: %v", err)
+	}
+	conn.Write([]byte("new admin\n"))
+	conn.Close()
+}
@@ -0,0 +1,264 @@
+//
+// verify.go - Checking that the hostname a client sends belongs to its destination
+//
+// Copyright (C) 2013 Ryan A. Chapman. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+//      this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+//      this list of conditions and the following disclaimer in the documentation
+//      and/or other materials provided with the distribution.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+// INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHORS
+// OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS;
+// OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR
+// OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF
+// ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+// With -S=1 or -hostsniff=1, the CONNECT request names the host from the
+// client's SNI or Host header, not the address it connected to. A client that
+// may only reach some hosts through the upstream could otherwise name one of
+// them while connecting somewhere else, or the other way round. With
+// -verifyname, the name is resolved (within -verifytimeout) and has to have
+// the destination among its addresses. When it doesn't, or can't be resolved,
+// the connection is
+//
+//   log     proxied with the name anyway, and logged
+//   ip      proxied to the destination address instead of the name
+//   reject  closed (plain HTTP requests get a 403)
+//
+// The same goes for the Host of each request forwarded with -httpports.
+//
+// What a name resolves to is cached for the shortest TTL among its records,
+// which the resolver is watched for since net.Resolver doesn't tell. Names
+// that don't come from DNS, such as those in /etc/hosts, aren't cached.
+//
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	verifyOff    = "off"
+	verifyLog    = "log"
+	verifyIP     = "ip"
+	verifyReject = "reject"
+)
+
+const (
+	defaultVerifyTimeout = time.Second
+
+	// names whose addresses are cached, beyond which no more are until
+	// some expire
+	verifyCacheSize = 65536
+)
+
+// lookupNetIP resolves the names to verify and says for how long the answer
+// holds. Tests replace it.
+var lookupNetIP = lookupNetIPWithTTL
+
+type verifyCacheEntry struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+// gVerifyCache holds the addresses of names verified, until their TTL runs
+// out.
+var gVerifyCache struct {
+	sync.Mutex
+	m map[string]verifyCacheEntry
+}
+
+// resolveName returns the addresses of name, from the cache if it has them.
+func resolveName(name string) ([]netip.Addr, error) {
+	key := strings.ToLower(name)
+	now := time.Now()
+	gVerifyCache.Lock()
+	e, ok := gVerifyCache.m[key]
+	gVerifyCache.Unlock()
+	if ok && e.expires.After(now) {
+		return e.addrs, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), gVerifyTimeout)
+	defer cancel()
+	addrs, ttl, err := lookupNetIP(ctx, "ip", name)
+	if err != nil || ttl <= 0 {
+		return addrs, err
+	}
+	gVerifyCache.Lock()
+	defer gVerifyCache.Unlock()
+	if gVerifyCache.m == nil {
+		gVerifyCache.m = make(map[string]verifyCacheEntry)
+	}
+	if len(gVerifyCache.m) >= verifyCacheSize {
+		for k, e := range gVerifyCache.m {
+			if !e.expires.After(now) {
+				delete(gVerifyCache.m, k)
+			}
+		}
+	}
+	if len(gVerifyCache.m) < verifyCacheSize {
+		gVerifyCache.m[key] = verifyCacheEntry{addrs: addrs, expires: now.Add(ttl)}
+	}
+	return addrs, nil
+}
+
+// lookupNetIPWithTTL resolves name with the Go resolver, and returns the
+// shortest TTL of the records in its answers as well, 0 if there were none.
+func lookupNetIPWithTTL(ctx context.Context, network, name string) ([]netip.Addr, time.Duration, error) {
+	rec := &ttlRecorder{}
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			c, err := d.DialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			return rec.wrap(c), nil
+		},
+	}
+	addrs, err := r.LookupNetIP(ctx, network, name)
+	return addrs, rec.shortest(), err
+}
+
+// ttlRecorder keeps the shortest TTL of the addresses in the DNS responses
+// read from the connections it wraps.
+type ttlRecorder struct {
+	mu   sync.Mutex
+	ttl  time.Duration
+	seen bool
+}
+
+// wrap returns c, watching the responses read from it.
+func (r *ttlRecorder) wrap(c net.Conn) net.Conn {
+	// net.Resolver tells datagrams from streams by net.PacketConn
+	if uc, ok := c.(*net.UDPConn); ok {
+		return &ttlPacketConn{UDPConn: uc, rec: r}
+	}
+	return &ttlStreamConn{Conn: c, rec: r}
+}
+
+func (r *ttlRecorder) record(msg []byte) {
+	_, records, err := dnsAddresses(msg)
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rec := range records {
+		if !r.seen || rec.ttl < r.ttl {
+			r.ttl, r.seen = rec.ttl, true
+		}
+	}
+}
+
+func (r *ttlRecorder) shortest() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ttl
+}
+
+// ttlPacketConn is a connection to a resolver over UDP, with one response
+// per read.
+type ttlPacketConn struct {
+	*net.UDPConn
+	rec *ttlRecorder
+}
+
+func (c *ttlPacketConn) Read(b []byte) (int, error) {
+	n, err := c.UDPConn.Read(b)
+	if n > 0 {
+		c.rec.record(b[:n])
+	}
+	return n, err
+}
+
+// ttlStreamConn is a connection to a resolver over TCP, where each response
+// comes after its length.
+type ttlStreamConn struct {
+	net.Conn
+	rec *ttlRecorder
+	buf []byte
+}
+
+func (c *ttlStreamConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.buf = append(c.buf, b[:n]...)
+	for len(c.buf) >= 2 {
+		l := 2 + int(binary.BigEndian.Uint16(c.buf))
+		if len(c.buf) < l {
+			break
+		}
+		c.rec.record(c.buf[2:l])
+		c.buf = c.buf[l:]
+	}
+	return n, err
+}
+
+func checkVerifyPolicy(v string) error {
+	return checkOneOf(v, verifyOff, verifyLog, verifyIP, verifyReject)
+}
+
+// verifyDestination returns an error if name doesn't resolve to dst, and
+// counts it.
+func verifyDestination(name string, dst netip.Addr) error {
+	dst = dst.Unmap()
+	if addr, err := netip.ParseAddr(name); err == nil {
+		if addr.Unmap() != dst {
+			incrDestinationMismatches()
+			return fmt.Errorf("is not %s", dst)
+		}
+		return nil
+	}
+	addrs, err := resolveName(name)
+	if err != nil {
+		incrDestinationLookupFailures()
+		return fmt.Errorf("could not be resolved: %v", err)
+	}
+	for _, addr := range addrs {
+		if addr.Unmap() == dst {
+			return nil
+		}
+	}
+	incrDestinationMismatches()
+	return fmt.Errorf("resolves to %v, not %s", addrs, dst)
+}
+
+// verifyName applies policy to a connection to dst that its client named
+// name. It returns whether name may be used for it and whether it may go
+// ahead at all, and err says what was wrong with name, if anything.
+func verifyName(policy, name string, dst netip.Addr) (useName, proceed bool, err error) {
+	if policy == "" || policy == verifyOff || name == "" {
+		return true, true, nil
+	}
+	if err = verifyDestination(name, dst); err == nil {
+		return true, true, nil
+	}
+	switch policy {
+	case verifyIP:
+		return false, true, err
+	case verifyReject:
+		return false, false, err
+	}
+	return true, true, err
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// fakeForwardLookups makes names resolve to the addresses in answers, with a
+// TTL of a minute, and names not in it fail to. It returns the number of
+// lookups done.
+func fakeForwardLookups(t *testing.T, answers map[string][]string) *int {
+	orig := lookupNetIP
+	resetVerifyCache := func() {
+		gVerifyCache.Lock()
+		gVerifyCache.m = nil
+		gVerifyCache.Unlock()
+	}
+	resetVerifyCache()
+	t.Cleanup(func() {
+		lookupNetIP = orig
+		resetVerifyCache()
+	})
+	calls := new(int)
+	lookupNetIP = func(ctx context.Context, network, name string) ([]netip.Addr, time.Duration, error) {
+		*calls++
+		addrs, ok := answers[name]
+		if !ok {
+			return nil, 0, errors.New("no such host")
+		}
+		var ret []netip.Addr
+		for _, a := range addrs {
+			ret = append(ret, netip.MustParseAddr(a))
+		}
+		return ret, time.Minute, nil
+	}
+	return calls
+}
+
+func TestVerifyName(t *testing.T) {
+	fakeForwardLookups(t, map[string][]string{
+		"www.example.com":   {"2001:db8::1", "192.0.2.10"},
+		"other.example.com": {"198.51.100.7"},
+	})
+	dst := netip.MustParseAddr("192.0.2.10")
+	tests := []struct {
+		policy, name     string
+		useName, proceed bool
+		mismatch, failed uint64 // counted
+	}{
+		{verifyOff, "other.example.com", true, true, 0, 0},
+		{verifyReject, "", true, true, 0, 0},
+		{verifyReject, "www.example.com", true, true, 0, 0},
+		{verifyReject, "192.0.2.10", true, true, 0, 0},
+		{verifyLog, "other.example.com", true, true, 1, 0},
+		{verifyIP, "other.example.com", false, true, 1, 0},
+		{verifyReject, "other.example.com", false, false, 1, 0},
+		{verifyReject, "198.51.100.7", false, false, 1, 0},
+		{verifyIP, "unknown.example.com", false, true, 0, 1},
+	}
+	for _, tt := range tests {
+		mismatches, failures := numDestinationMismatches(), numDestinationLookupFailures()
+		useName, proceed, err := verifyName(tt.policy, tt.name, dst)
+		if useName != tt.useName || proceed != tt.proceed {
+			t.Errorf("verifyName(%s, %q) = %v, %v, want %v, %v", tt.policy, tt.name, useName, proceed, tt.useName, tt.proceed)
+		}
+		if (err != nil) != (tt.mismatch+tt.failed > 0) {
+			t.Errorf("verifyName(%s, %q) returned error %v", tt.policy, tt.name, err)
+		}
+		if numDestinationMismatches()-mismatches != tt.mismatch || numDestinationLookupFailures()-failures != tt.failed {
+			t.Errorf("verifyName(%s, %q) counted %d mismatches and %d failed lookups, want %d and %d", tt.policy, tt.name,
+				numDestinationMismatches()-mismatches, numDestinationLookupFailures()-failures, tt.mismatch, tt.failed)
+		}
+	}
+
+	// clients connecting over IPv6 to IPv4 destinations
+	if err := verifyDestination("www.example.com", netip.MustParseAddr("::ffff:192.0.2.10")); err != nil {
+		t.Errorf("verifyDestination() of a v4-mapped destination: %v", err)
+	}
+}
+
+func TestVerifyNameCache(t *testing.T) {
+	calls := fakeForwardLookups(t, map[string][]string{"www.example.com": {"192.0.2.10"}})
+	dst := netip.MustParseAddr("192.0.2.10")
+	for _, name := range []string{"www.example.com", "WWW.example.com", "unknown.example.com", "unknown.example.com"} {
+		verifyDestination(name, dst)
+	}
+	// failed lookups aren't cached
+	if *calls != 3 {
+		t.Errorf("%d lookups, want 3", *calls)
+	}
+	gVerifyCache.Lock()
+	e := gVerifyCache.m["www.example.com"]
+	e.expires = time.Now().Add(-time.Second)
+	gVerifyCache.m["www.example.com"] = e
+	gVerifyCache.Unlock()
+	verifyDestination("www.example.com", dst)
+	if *calls != 4 {
+		t.Errorf("expired name was not looked up again")
+	}
+}
+
+func TestTTLRecorder(t *testing.T) {
+	server := startFakeResolver(t,
+		testRR{dnsTypeA, 300, []byte{192, 0, 2, 10}},
+		testRR{dnsTypeA, 60, []byte{192, 0, 2, 11}})
+
+	rec := &ttlRecorder{}
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			c, err := net.Dial(network, server)
+			if err != nil {
+				return nil, err
+			}
+			return rec.wrap(c), nil
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := r.LookupNetIP(ctx, "ip4", "www.example.com")
+	if err != nil || len(addrs) != 2 {
+		t.Fatalf("LookupNetIP() = %v, %v", addrs, err)
+	}
+	if got := rec.shortest(); got != time.Minute {
+		t.Errorf("TTL over UDP = %v, want 1m", got)
+	}
+
+	rec = &ttlRecorder{}
+	c, err := net.Dial("tcp", server)
+	if err != nil {
+		t.Fatalf("could not dial: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	wc := rec.wrap(c)
+	writeDNSTCP(wc, dnsQuery(1, "www.example.com"))
+	if _, err := readDNSTCP(wc); err != nil {
+		t.Fatalf("no answer over TCP: %v", err)
+	}
+	if got := rec.shortest(); got != time.Minute {
+		t.Errorf("TTL over TCP = %v, want 1m", got)
+	}
+}
+
+func TestHTTPForwardingVerifyName(t *testing.T) {
+	fakeForwardLookups(t, map[string][]string{
+		"www.example.com":   {"192.0.2.10"},
+		"other.example.com": {"198.51.100.7"},
+	})
+	upstream, reqs := fakeHTTPProxy(t,
+		"HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	cfg, _ := newProxyConfig([]string{upstream}, nil, nil)
+	cfg.verifyPolicy = verifyIP
+	orig := currentConfig()
+	setConfig(cfg)
+	defer setConfig(orig)
+
+	client, clientSide := tcpPair(t)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	tun := handleHTTPForwarding(clientSide, "192.0.2.10", 80, &clientPeek{protocol: protoHTTP}, cfg.proxyServers)
+	if tun == nil {
+		t.Fatalf("handleHTTPForwarding() did not set up a tunnel")
+	}
+	go relayTunnel(tun, tun.serverName())
+
+	io.WriteString(client, "GET /a HTTP/1.1\r\nHost: www.example.com\r\n\r\nGET /b HTTP/1.1\r\nHost: other.example.com\r\n\r\n")
+	for _, want := range []struct{ uri, host string }{
+		{"http://www.example.com/a", "www.example.com"},
+		{"http://192.0.2.10:80/b", "192.0.2.10:80"},
+	} {
+		req := <-reqs
+		if req == nil {
+			t.Fatalf("upstream did not get %s", want.uri)
+		}
+		if req.RequestURI != want.uri || req.Host != want.host {
+			t.Errorf("upstream got %s with Host %s, want %s with Host %s", req.RequestURI, req.Host, want.uri, want.host)
+		}
+	}
+
+	upstream, _ = fakeHTTPProxy(t)
+	cfg, _ = newProxyConfig([]string{upstream}, nil, nil)
+	cfg.verifyPolicy = verifyReject
+	setConfig(cfg)
+	client, clientSide = tcpPair(t)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	tun = handleHTTPForwarding(clientSide, "192.0.2.10", 80, &clientPeek{protocol: protoHTTP}, cfg.proxyServers)
+	if tun == nil {
+		t.Fatalf("handleHTTPForwarding() did not set up a tunnel")
+	}
+	go relayTunnel(tun, tun.serverName())
+	io.WriteString(client, "GET / HTTP/1.1\r\nHost: other.example.com:80\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("no response: %v", err)
+	}
+	if resp.StatusCode != http.StatusForbidden || resp.Header.Get("X-AnyProxy-Error") != "ERR_DESTINATION_MISMATCH" {
+		t.Errorf("got %s %q, want 403 ERR_DESTINATION_MISMATCH", resp.Status, resp.Header.Get("X-AnyProxy-Error"))
+	}
+}